@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -28,9 +30,9 @@ var g_ColorMap = ColorMap{
 //var g_defaultColorsArg = g_ColorMap.String()
 
 // Parses --source type:path
+// The kinds come from the registered SourceLoaders.  See sourceLoaderKinds()
 var g_SourceOptions = SourceRef{
 	Cond: "if0",
-	Kind: "bucket|buckets|html",
 	Path: ":active|:rasa",
 }
 
@@ -42,8 +44,20 @@ var g_SearchQueryOptions = SearchQuery{
 var g_SearchQueryOptionsFieldsStr = strings.Join(g_SearchQueryOptions.Fields, ",")
 
 var g_SourceNamedPathsRE = regexp.MustCompile(g_SourceOptions.Path)
-var g_SourceFormatRE = regexp.MustCompile(`^(?:(?P<cond>` + g_SourceOptions.Cond + `): )?(?:\[(?P<kind>` + g_SourceOptions.Kind + `)\] )?(?P<path>.*)$`)
-var g_SourcePatternHuman = `"<if0:> [<` + g_SourceOptions.Kind + `>] <` + g_SourceOptions.Path + ` or path/url>"`
+
+// built on first use, after the init() functions have registered the SourceLoaders
+var g_SourceFormatRE *regexp.Regexp
+
+func sourceFormatRE() *regexp.Regexp {
+	if g_SourceFormatRE == nil {
+		g_SourceFormatRE = regexp.MustCompile(`^(?:(?P<cond>` + g_SourceOptions.Cond + `): )?(?:\[(?P<kind>` + sourceLoaderKindsRE() + `)\] )?(?P<path>.*?)(?:@(?P<ref>[^@:\\\s]+))?$`)
+	}
+	return g_SourceFormatRE
+}
+
+func sourcePatternHuman() string {
+	return `"<if0:> [<` + sourceLoaderKinds("|") + `>] <` + g_SourceOptions.Path + ` or path/url><@git-ref>"`
+}
 
 func (sources *SourceRefs) String() string {
 	return fmt.Sprintf("%v", *sources)
@@ -53,10 +67,10 @@ func (sources *SourceRefs) Set(value string) error {
 	//fmt.Printf("%v\n", value)
 	source := SourceRef{}
 
-	m := g_SourceFormatRE.FindStringSubmatch(value)
+	m := sourceFormatRE().FindStringSubmatch(value)
 	if m == nil {
 		return fmt.Errorf(`Given source does not match the required pattern:
-PATTERN: `+g_SourcePatternHuman+`
+PATTERN: `+sourcePatternHuman()+`
 GIVEN:   %s
 `, value)
 	}
@@ -64,6 +78,18 @@ GIVEN:   %s
 	source.Cond = m[1]
 	source.Kind = m[2]
 	source.Path = m[3]
+	source.Ref = m[4]
+
+	// only git sources can be pinned to a ref.  Otherwise the @ belongs to the path/url (e.g. user@host, file@2.zip)
+	if source.Ref != "" {
+		whole := source
+		whole.Path, whole.Ref = source.Path+"@"+source.Ref, ""
+		wholeKind := sourceLoaderKindOf(&whole)
+		isGitRef := sourceLoaderKindOf(&source) == "git" && hasUrlPath(source.Path)
+		if !isGitRef || wholeKind != "git" && wholeKind != "bucket" && wholeKind != "" {
+			source = whole
+		}
+	}
 
 	// check for named path
 	m = g_SourceNamedPathsRE.FindStringSubmatch(source.Path)
@@ -73,11 +99,28 @@ GIVEN:   %s
 		source.Kind = src.Kind
 		source.Path = src.Path
 	}
+
+	// a url's user:password becomes the auth of its host, so it isn't shown or used in cache names
+	source.Path = takeUrlCredentials(source.Path)
 	*sources = append(*sources, source)
 
 	return nil
 }
 
+// the path with its @ref, if any
+func (src *SourceRef) Location() string {
+	if src.Ref == "" {
+		return src.Path
+	}
+	return src.Path + "@" + src.Ref
+}
+
+// for urls, an @ before the path is the user (user@host), not a ref
+func hasUrlPath(path string) bool {
+	_, rest, found := strings.Cut(path, "://")
+	return !found || strings.Contains(rest, "/")
+}
+
 func (colors *ColorMap) StringAll(keepEmpty bool) string {
 	keyvalstrs := make([]string, 0, len(*colors))
 	for key, color := range *colors {
@@ -121,9 +164,13 @@ type ParsedArgs struct {
 	query   SearchQuery
 	sources SourceRefs
 	fields  string
+	arch    string
 	cache   float64
 	colors  *ColorMap
 	linelen int
+	jobs    int
+	index   bool
+	offline bool
 	hook    bool
 	merge   bool
 	debug   bool
@@ -131,13 +178,14 @@ type ParsedArgs struct {
 
 func myUsage() {
 	// os.Args[0]
-	fmt.Print(colorize("light_cyan", "scoop-search-multisource.exe : Searches Scoop buckets: local, remote, zip, html") + `
+	fmt.Print(colorize("light_cyan", "scoop-search-multisource.exe : Searches Scoop buckets: local, remote, zip, tar, html") + `
 
 ` + colorize("yellow", "VERSION") + `: ` + g_Version + `
 ` + colorize("yellow", "   HOME") + `: https://github.com/plicit/scoop-search-multisource
 
 ` + colorize("yellow", "  ALIAS") + `: scoops.exe
 ` + colorize("yellow", "  USAGE") + `: scoops.exe [OPTIONS] <search-term-or-regexp>
+` + colorize("yellow", "  CACHE") + `: scoops.exe cache list | clear [pattern] | prune [-older-than 30d] [-max-size 500MB]
 ` + colorize("yellow", "   NOTE") + `: search-term is case-insensitive.  Prefix with "(?-i)" for case-sensitive.  See https://pkg.go.dev/regexp/syntax
 
 ` + colorize("yellow", "EXAMPLE") + `: scoops.exe -debug -merge=0 -source :active -source "if0: :rasa" -fields "` + g_SearchQueryOptionsFieldsStr + `" "\bqr\b"
@@ -162,16 +210,39 @@ func parseArgs() (args *ParsedArgs) {
 	flag.Float64Var(&args.cache, "cache", cache_default, "cache duration in days.")
 	flag.Var(args.colors, "colors", `colormap for output. "none" deletes the colormap.`)
 	flag.IntVar(&args.linelen, "linelen", 120, "max line length for results (trims description)")
+	flag.IntVar(&args.jobs, "jobs", runtime.NumCPU(), "number of manifests to read and parse in parallel")
+	flag.DurationVar(&g_HttpConnectTimeout, "connect-timeout", g_HttpConnectTimeout, "timeout for connecting to a server when downloading")
+	flag.DurationVar(&g_HttpReadTimeout, "read-timeout", g_HttpReadTimeout, "timeout for a server's response, and then for each read of a download")
+	flag.IntVar(&g_HttpRetries, "retries", g_HttpRetries, "number of times a download is retried after a 5xx response, a reset connection, or a timeout")
+	flag.Var(&g_Config.TLS.CAFiles, "ca-file", "a PEM file of CA certificates to trust along with the system's, e.g. of a TLS-inspecting proxy. (multiple allowed) (scoop config scoops_ca_files)")
+	flag.Var(&g_Config.TLS.ClientCerts, "client-cert", "host=cert.pem[,key.pem] -- a client certificate for a server that requires one. (multiple allowed) (scoop config scoops_client_certs)")
+	flag.Var(&g_Config.TLS.InsecureHosts, "insecure-skip-verify", "a host (or glob like *.corp.example) whose TLS certificate is NOT verified.  INSECURE! (multiple allowed) (scoop config scoops_insecure_hosts)")
+	flag.DurationVar(&g_GitTimeout, "git-timeout", g_GitTimeout, "timeout for each git command when cloning or fetching a git source")
+	flag.BoolVar(&args.index, "index", true, "use the saved index of each bucket's apps until the bucket changes. -index=false parses every manifest again")
+	// -offline overrides $env:SCOOPS_OFFLINE, which overrides `scoop config scoops_offline true`
+	offline_default := g_Config.Offline
+	if value, ok := os.LookupEnv("SCOOPS_OFFLINE"); ok {
+		if b, err := strconv.ParseBool(value); err == nil {
+			offline_default = b
+		}
+	}
+	flag.BoolVar(&args.offline, "offline", offline_default, "never use the network: remote sources use their cache however old, or are skipped ($env:SCOOPS_OFFLINE, scoop config scoops_offline)")
+	flag.StringVar(&args.arch, "arch", g_Arch, "the architecture whose bins are matched and shown: 64bit, 32bit, arm64, or all")
 	flag.StringVar(&args.fields, "fields", "name,bins", `app manifest fields to search: `+g_SearchQueryOptionsFieldsStr)
 	flag.Var(&args.sources, "source", `a specific source to search. (multiple allowed) 
 
-SOURCE FORMAT: `+g_SourcePatternHuman+`
+SOURCE FORMAT: `+sourcePatternHuman()+`
   if0: -- only use the source as a fallback if there were 0 previous matches
+  @git-ref -- search a git source at a branch, tag, or commit
 
+SOURCE KINDS: (when omitted, the kind is detected from the path/url)
+`+describeSourceLoaders()+`
 EXAMPLES:
   scoops.exe -source "mybucket.zip" -source "if0: :rasa" python
   scoops.exe -source "[html] https://rasa.github.io/scoop-directory/by-score.html" actools
+  scoops.exe -source "[markdown] https://raw.githubusercontent.com/rasa/scoop-directory/master/by-score.md" actools
   scoops.exe -source "[bucket] https://github.com/ScoopInstaller/Versions" python
+  scoops.exe -source "https://github.com/ScoopInstaller/Versions@master" python
   scoops.exe -source "%USERPROFILE%\scoop\buckets\main" python
 `)
 
@@ -183,6 +254,21 @@ EXAMPLES:
 		os.Exit(0)
 	}
 
+	// --jobs N
+	g_Jobs = MaxInt(1, args.jobs)
+
+	// --offline
+	g_Offline = args.offline
+
+	// --index
+	g_UseIndex = args.index
+
+	// --arch
+	if !validArch(args.arch) {
+		checkWith(fmt.Errorf("%q is not 64bit, 32bit, arm64, or all", args.arch), "Unknown -arch")
+	}
+	g_Arch = args.arch
+
 	// --cache X (in minutes)
 	g_CacheDuration = time.Duration(args.cache * float64(24*time.Hour))
 
@@ -209,20 +295,18 @@ EXAMPLES:
 	return
 }
 
-//// ----------
-//// Flag type to aggregate multiple args with the same keyword
-// --source <type>:<value> option
-//type StringSlice []string
-//
-//func (slice *StringSlice) String() string {
-//	return fmt.Sprintf("%v", *slice)
-//}
-//
-//func (slice *StringSlice) Set(value string) error {
-//	//fmt.Printf("%v\n", value)
-//	*slice = append(*slice, value)
-//	return nil
-//}
+// ----------
+// Flag type to aggregate multiple args with the same keyword.  Each may also be a ";" separated list
+type StringList []string
+
+func (list *StringList) String() string {
+	return strings.Join(*list, ";")
+}
+
+func (list *StringList) Set(value string) error {
+	*list = append(*list, splitList(value)...)
+	return nil
+}
 
 // ----------
 // --hook option
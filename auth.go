@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	net_url "net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//=========================================================
+// AUTH: credentials for private buckets and archives, by host
+//=========================================================
+
+// from scoop's gh_token ($env:SCOOP_GH_TOKEN), then `scoop config scoops_auth`, then $env:SCOOPS_AUTH, then the user:password of source urls.
+// A later entry for the same header wins.
+type HostAuth struct {
+	Kind  string // bearer, basic or header
+	Name  string // the basic username, or the header's name
+	Value string // the token, password or header value
+}
+
+// "host=bearer:TOKEN;host=basic:USER:PASSWORD;host=header:NAME:VALUE".  The host may be a glob like *.corp.example,
+// and the values may use $env:NAME so the secret needn't be in the config
+type AuthMap map[string][]HostAuth
+
+var g_AuthMutex sync.RWMutex
+
+var g_AuthEnvRE = regexp.MustCompile(`\$env:(\w+)`)
+
+// the hosts given scoop's gh_token.  github.com gets basic auth, which git over https accepts too
+var g_GitHubTokenHosts = []string{"api.github.com", "codeload.github.com", "raw.githubusercontent.com"}
+
+func (auths *AuthMap) String() string {
+	g_AuthMutex.RLock()
+	defer g_AuthMutex.RUnlock()
+	var entries []string
+	for host, list := range *auths {
+		for _, auth := range list {
+			entries = append(entries, host+"="+auth.String())
+		}
+	}
+	return strings.Join(entries, ";")
+}
+
+func (auths *AuthMap) Set(value string) error {
+	for _, entry := range splitList(value) {
+		host, spec, _ := strings.Cut(entry, "=")
+		kind, rest, _ := strings.Cut(spec, ":")
+		auth := HostAuth{Kind: strings.ToLower(kind)}
+		switch auth.Kind {
+		case "bearer":
+			auth.Value = rest
+		case "basic", "header":
+			auth.Name, auth.Value, _ = strings.Cut(rest, ":")
+			auth.Value = strings.TrimLeft(auth.Value, " ")
+		default:
+			return fmt.Errorf("parse error `host=bearer:TOKEN|basic:USER:PASSWORD|header:NAME:VALUE`: %v", redactAuthEntry(entry))
+		}
+		if host == "" || auth.Kind == "header" && auth.Name == "" {
+			return fmt.Errorf("parse error `host=bearer:TOKEN|basic:USER:PASSWORD|header:NAME:VALUE`: %v", redactAuthEntry(entry))
+		}
+		auth.Name, auth.Value = expandAuthEnv(auth.Name), expandAuthEnv(auth.Value)
+		auths.add(host, auth)
+	}
+	return nil
+}
+
+func (auths *AuthMap) add(host string, auth HostAuth) {
+	g_AuthMutex.Lock()
+	defer g_AuthMutex.Unlock()
+	if *auths == nil {
+		*auths = AuthMap{}
+	}
+	host = strings.ToLower(host)
+	(*auths)[host] = append((*auths)[host], auth)
+}
+
+// scoop's gh_token, for private github repos and their archives
+func (auths *AuthMap) addGitHubToken(token string) {
+	if token == "" {
+		return
+	}
+	auths.add("github.com", HostAuth{Kind: "basic", Name: "x-access-token", Value: token})
+	for _, host := range g_GitHubTokenHosts {
+		auths.add(host, HostAuth{Kind: "bearer", Value: token})
+	}
+}
+
+func expandAuthEnv(value string) string {
+	return g_AuthEnvRE.ReplaceAllStringFunc(value, func(name string) string {
+		return os.Getenv(name[len("$env:"):])
+	})
+}
+
+// the header this sends
+func (auth HostAuth) Header() (name string, value string) {
+	switch auth.Kind {
+	case "bearer":
+		return "Authorization", "Bearer " + auth.Value
+	case "basic":
+		return "Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(auth.Name+":"+auth.Value))
+	}
+	return auth.Name, auth.Value
+}
+
+// never shows the secret
+func (auth HostAuth) String() string {
+	// the basic username may be a token too, as in https://TOKEN@host/
+	if auth.Kind == "header" {
+		return auth.Kind + ":" + auth.Name + ":***"
+	}
+	return auth.Kind + ":***"
+}
+
+func (auth HostAuth) MarshalJSON() ([]byte, error) {
+	return json.Marshal(auth.String())
+}
+
+func redactAuthEntry(entry string) string {
+	host, _, _ := strings.Cut(entry, "=")
+	return host + "=***"
+}
+
+// the headers for host, in order, with later ones for the same header winning
+func authHeadersFor(host string) http.Header {
+	g_AuthMutex.RLock()
+	defer g_AuthMutex.RUnlock()
+	var header http.Header
+	apply := func(list []HostAuth) {
+		for _, auth := range list {
+			if header == nil {
+				header = http.Header{}
+			}
+			name, value := auth.Header()
+			header.Set(name, value)
+		}
+	}
+	// the host's own entries win over those of globs
+	host = strings.ToLower(host)
+	for pattern, list := range g_Config.Auth {
+		if pattern != host && matchHost(pattern, host) {
+			apply(list)
+		}
+	}
+	apply(g_Config.Auth[host])
+	return header
+}
+
+// adds the auth headers of the request's host, unless the request already has them (e.g. from go-git or the url's user:password)
+func withAuth(request *http.Request) *http.Request {
+	header := authHeadersFor(request.URL.Hostname())
+	if header == nil {
+		return request
+	}
+	request = request.Clone(request.Context())
+	for name, values := range header {
+		if request.Header.Get(name) == "" {
+			request.Header[name] = values
+		}
+	}
+	return request
+}
+
+//---------------------------------------------------------
+// credentials in urls
+//---------------------------------------------------------
+
+// moves the user:password of url into the auth of its host, so the url can be shown, logged, and used as a cache name
+func takeUrlCredentials(url string) string {
+	if !isUrl(url) {
+		return url
+	}
+	parsed, err := net_url.Parse(url)
+	if err != nil || parsed.User == nil {
+		return url
+	}
+	password, _ := parsed.User.Password()
+	g_Config.Auth.add(parsed.Hostname(), HostAuth{Kind: "basic", Name: parsed.User.Username(), Value: password})
+	parsed.User = nil
+	return parsed.String()
+}
+
+// scoop's proxy config with any user:password replaced by ***
+func redactProxy(scoopProxy string) string {
+	if i := strings.LastIndex(scoopProxy, "@"); i >= 0 && !strings.EqualFold(scoopProxy[:i], "currentuser") {
+		return "***" + scoopProxy[i:]
+	}
+	return scoopProxy
+}
+
+//---------------------------------------------------------
+// the auth for git, which doesn't read scoop's config
+//---------------------------------------------------------
+
+// the GIT_CONFIG_* pairs that make git send the auth headers of url's host
+func gitAuthConfig(url string) (config []string) {
+	parsed, err := net_url.Parse(url)
+	if err != nil || parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return
+	}
+	header := authHeadersFor(parsed.Hostname())
+	for name, values := range header {
+		for _, value := range values {
+			config = append(config, "http."+parsed.Scheme+"://"+parsed.Host+"/.extraHeader", name+": "+value)
+		}
+	}
+	return
+}
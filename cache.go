@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	net_url "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//=========================================================
+// CACHE management for network requests
+//=========================================================
+
+var g_CacheDuration time.Duration = 24 * time.Hour
+
+//func init() {
+//	g_CacheDuration = 24 * time.Hour
+//}
+
+// -offline: never touch the network, and use whatever cache exists however old
+var g_Offline bool
+
+// returned by the remote loaders when offline and there is no cache to use
+var ErrOfflineNoCache = errors.New("offline, and there is no cache")
+
+// the age of each url's cache when it was used, for the source headers
+var g_CacheAges sync.Map
+
+func recordCacheAge(url string, age time.Duration) {
+	g_CacheAges.Store(url, age)
+}
+
+// the age of url's cache, if this run used one
+func cacheAgeOf(url string) (age time.Duration, ok bool) {
+	value, ok := g_CacheAges.Load(url)
+	if ok {
+		age = value.(time.Duration)
+	}
+	return
+}
+
+func scoopCache(category string) (cachePath string) {
+	cachePath = filepath.Join(g_Config.ScoopCacheDir, category)
+	checkWith(os.MkdirAll(cachePath, 0700), "Can't create cache directory: "+cachePath)
+	return
+}
+
+// CacheMeta is stored next to a cached download as "<file>.meta"
+type CacheMeta struct {
+	Url string
+	// validators for conditional requests
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+	// integrity of the cached file
+	Size   int64  `json:",omitempty"`
+	Sha256 string `json:",omitempty"`
+	// for pruning the least recently used
+	LastUsed time.Time
+}
+
+func cacheMetaPath(cacheFilePath string) string {
+	return cacheFilePath + ".meta"
+}
+
+// loads the sidecar of a cached file, or nil if there is none
+func loadCacheMeta(cacheFilePath string) (meta *CacheMeta) {
+	body, err := os.ReadFile(cacheMetaPath(cacheFilePath))
+	if err != nil {
+		return nil
+	}
+	meta = &CacheMeta{}
+	if json.Unmarshal(body, meta) != nil {
+		return nil
+	}
+	return meta
+}
+
+func (meta *CacheMeta) save(cacheFilePath string) error {
+	body, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cacheMetaPath(cacheFilePath), bytes.NewReader(body), nil)
+}
+
+// records that the cache of url at cachePath (a file or a git repo folder) was just used
+func touchCacheMeta(out io.Writer, cachePath string, url string, meta *CacheMeta) {
+	if meta == nil {
+		meta = &CacheMeta{Url: url}
+	}
+	meta.LastUsed = time.Now()
+	if err := meta.save(cachePath); err != nil && DEBUG {
+		fmt.Fprintf(out, colorize("error", "*** Couldn't save cache meta: %s\n"), err)
+	}
+}
+
+// checks the cached file against the size and hash in its sidecar.
+// A cache without a sidecar (or hash) can't be verified, so it is neither valid nor corrupt.
+func (meta *CacheMeta) verify(cacheFilePath string, size int64) (valid bool, corrupt bool) {
+	if meta == nil || meta.Sha256 == "" {
+		return false, false
+	}
+	if meta.Size != size {
+		return false, true
+	}
+
+	file, err := os.Open(cacheFilePath)
+	if err != nil {
+		return false, true
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return false, true
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != meta.Sha256 {
+		return false, true
+	}
+	return true, false
+}
+
+// writes body to a temp file beside path, then renames it into place, so an interrupted write never leaves a partial file.
+// The body is also written to tee (e.g. a hash) if given.
+func writeFileAtomic(path string, body io.Reader, tee io.Writer) (err error) {
+	dir, name := filepath.Split(path)
+	tempFile, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tempFile.Close()
+			os.Remove(tempFile.Name())
+		}
+	}()
+
+	writer := io.Writer(tempFile)
+	if tee != nil {
+		writer = io.MultiWriter(tempFile, tee)
+	}
+	if _, err = io.Copy(writer, body); err != nil {
+		return
+	}
+	if err = tempFile.Sync(); err != nil {
+		return
+	}
+	if err = tempFile.Close(); err != nil {
+		return
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+// downloads url to cacheFilePath unless the cache is younger than g_CacheDuration.
+// An expired cache is revalidated with its ETag / Last-Modified, and only has its time refreshed if unchanged.
+// A cache that fails its size/hash check is removed and downloaded again.
+func cacheGetUrl(out io.Writer, cacheFilePath string, url string) (err error) {
+	now := time.Now()
+	f, statErr := os.Stat(cacheFilePath)
+	cache_exists := statErr == nil
+
+	meta := loadCacheMeta(cacheFilePath)
+	cache_valid := false
+	if cache_exists {
+		valid, corrupt := meta.verify(cacheFilePath, f.Size())
+		if corrupt {
+			fmt.Fprintf(out, colorize("error", "*** Corrupted cache, downloading again: %s\n"), cacheFilePath)
+			os.Remove(cacheFilePath)
+			cache_exists, meta = false, nil
+		}
+		cache_valid = valid
+	}
+
+	age := time.Duration(0)
+	if cache_exists {
+		age = now.Sub(f.ModTime())
+	}
+
+	// offline, any cache will do, even one without a sidecar
+	if g_Offline {
+		if !cache_exists {
+			return fmt.Errorf("%w of %s", ErrOfflineNoCache, url)
+		}
+		fmt.Fprintf(out, colorize("source.status", "offline, using %s old cache: %s\n"), fmtDuration(age), cacheFilePath)
+		touchCacheMeta(out, cacheFilePath, url, meta)
+		recordCacheAge(url, age)
+		return nil
+	}
+
+	// an unverified cache (from an older version without a sidecar) is downloaded again
+	if cache_valid && age <= g_CacheDuration {
+		fmt.Fprintf(out, colorize("source.status", "using %s old cache: %s\n"), fmtDuration(age), cacheFilePath)
+		touchCacheMeta(out, cacheFilePath, url, meta)
+		recordCacheAge(url, age)
+		return nil
+	}
+
+	request, err := http.NewRequestWithContext(withOutput(context.Background(), out), http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	// only send the validators if they belong to the file we still have
+	if cache_valid && meta.Url == url {
+		if meta.ETag != "" {
+			request.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			request.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+		fmt.Fprintf(out, "Revalidating: %s\n", url)
+	} else {
+		fmt.Fprintf(out, "Downloading: %s\n", url)
+	}
+
+	return httpDo(out, newHttpClient(), request, func(response *http.Response) (err error) {
+		if response.StatusCode == http.StatusNotModified && cache_exists {
+			fmt.Fprintf(out, colorize("source.status", "not modified, refreshed %s old cache: %s\n"), fmtDuration(age), cacheFilePath)
+			touchCacheMeta(out, cacheFilePath, url, meta)
+			recordCacheAge(url, 0)
+			return os.Chtimes(cacheFilePath, now, now)
+		}
+
+		if response.StatusCode != 200 {
+			return fmt.Errorf("failed to fetch %s: %s", url, response.Status)
+		}
+
+		// save to cache file.  The previous cache stays intact if the download fails or is cut short
+		// (the response body errors if it is shorter than its Content-Length)
+		hash := sha256.New()
+		counter := &countingWriter{}
+		err = writeFileAtomic(cacheFilePath, response.Body, io.MultiWriter(hash, counter))
+		if err != nil {
+			return fmt.Errorf("couldn't write cache file %s: %w", cacheFilePath, err)
+		}
+
+		meta := &CacheMeta{
+			Url:          url,
+			ETag:         response.Header.Get("ETag"),
+			LastModified: response.Header.Get("Last-Modified"),
+			Size:         counter.count,
+			Sha256:       hex.EncodeToString(hash.Sum(nil)),
+			LastUsed:     now,
+		}
+		if err := meta.save(cacheFilePath); err != nil {
+			fmt.Fprintf(out, colorize("error", "*** Couldn't save cache validators: %s\n"), err)
+		}
+		recordCacheAge(url, 0)
+		return nil
+	})
+}
+
+// cacheGetUrl, but if the download fails and there is a cache, the stale cache is used instead
+func cacheGetUrlOrStale(out io.Writer, cacheFilePath string, url string) error {
+	err := cacheGetUrl(out, cacheFilePath, url)
+	if err == nil || errors.Is(err, ErrOfflineNoCache) {
+		return err
+	}
+	f, statErr := os.Stat(cacheFilePath)
+	if statErr != nil {
+		return err
+	}
+	age := time.Since(f.ModTime())
+	fmt.Fprintf(out, colorize("error", "*** %s\n"), err)
+	fmt.Fprintf(out, "Failed to download, so using %s old cache: %s\n", fmtDuration(age), cacheFilePath)
+	touchCacheMeta(out, cacheFilePath, url, loadCacheMeta(cacheFilePath))
+	recordCacheAge(url, age)
+	return nil
+}
+
+// counts the bytes written through it
+type countingWriter struct {
+	count int64
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	writer.count += int64(len(p))
+	return len(p), nil
+}
+
+//=========================================================
+// CACHE commands: scoops cache list|clear|prune
+//=========================================================
+
+// a cached download or git repo in scoopCache("buckets"), or a saved index in scoopCache("index")
+type CacheEntry struct {
+	Path     string
+	Url      string
+	Kind     string
+	Size     int64
+	Modified time.Time // when it was last downloaded, or revalidated
+	LastUsed time.Time
+}
+
+// the source kind of a cache entry by the extension its loader appends
+var g_CacheKindsByExt = map[string]string{
+	".zip":    "zip",
+	".tar":    "tar",
+	".html":   "html",
+	".md":     "markdown",
+	".json":   "manifests-json",
+	".sqlite": "sqlite",
+}
+
+func cacheCommandUsage() {
+	fmt.Print(colorize("yellow", "  USAGE") + `: scoops.exe cache <command>
+
+` + colorize("yellow", "COMMANDS") + `:
+
+  list                     list the cached downloads, git repos and indexes: kind, size, age, last used, url
+  clear [pattern]          delete the cache entries whose url matches the regexp pattern (default: all)
+  prune [OPTIONS]          delete the least recently used cache entries
+
+` + colorize("yellow", "PRUNE OPTIONS") + `:
+
+  -older-than duration     delete entries not used within this duration, e.g. 30d, 2w, 12h
+  -max-size size           then delete the least recently used entries until the cache fits, e.g. 500MB, 2GB
+`)
+}
+
+// only these make `scoops cache ...` the cache command, so `scoops cache` alone still searches for "cache"
+func isCacheCommand(command string) bool {
+	return command == "list" || command == "clear" || command == "prune"
+}
+
+// runs `scoops cache ...` and returns the exit code
+func runCacheCommand(args []string) int {
+	if len(args) == 0 {
+		cacheCommandUsage()
+		return 1
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = cacheList()
+	case "clear":
+		pattern := ""
+		if len(args) > 1 {
+			pattern = args[1]
+		}
+		err = cacheClear(pattern)
+	case "prune":
+		flags := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+		olderThan := flags.String("older-than", "", "delete entries not used within this duration, e.g. 30d")
+		maxSize := flags.String("max-size", "", "delete the least recently used entries until the cache fits, e.g. 500MB")
+		if err = flags.Parse(args[1:]); err != nil {
+			return 1
+		}
+		err = cachePrune(*olderThan, *maxSize)
+	default:
+		cacheCommandUsage()
+		return 1
+	}
+
+	if err != nil {
+		fmt.Printf(colorize("error", "*** %s\n"), err)
+		return 1
+	}
+	return 0
+}
+
+// lists the entries of scoopCache("buckets"), without their sidecars and temp files, and then the indexes
+func loadCacheEntries() (entries []*CacheEntry, err error) {
+	cacheDir := scoopCache("buckets")
+	dirEntries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return
+	}
+
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if strings.HasSuffix(name, ".meta") || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+
+		entry := &CacheEntry{Path: filepath.Join(cacheDir, name), Modified: info.ModTime(), LastUsed: info.ModTime()}
+		escapedUrl := name
+		if dirEntry.IsDir() {
+			entry.Kind = "git"
+			entry.Size = dirSize(entry.Path)
+		} else {
+			ext := filepath.Ext(name)
+			entry.Kind = g_CacheKindsByExt[ext]
+			entry.Size = info.Size()
+			escapedUrl = strings.TrimSuffix(name, ext)
+		}
+
+		if meta := loadCacheMeta(entry.Path); meta != nil {
+			entry.Url = meta.Url
+			if !meta.LastUsed.IsZero() {
+				entry.LastUsed = meta.LastUsed
+			}
+		}
+		if entry.Url == "" {
+			entry.Url, _ = net_url.QueryUnescape(escapedUrl)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	indexEntries, err := loadIndexCacheEntries()
+	return append(entries, indexEntries...), err
+}
+
+// lists the indexes of scoopCache("index") by the source they index.  Using an index updates its time (see loadIndexEntry)
+func loadIndexCacheEntries() (entries []*CacheEntry, err error) {
+	indexDir := scoopCache("index")
+	dirEntries, err := os.ReadDir(indexDir)
+	if err != nil {
+		return
+	}
+
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !strings.HasSuffix(name, ".gob") {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		entry := &CacheEntry{Path: filepath.Join(indexDir, name), Kind: "index", Size: info.Size(), Modified: info.ModTime(), LastUsed: info.ModTime()}
+		entry.Url = cacheKeyUrl(indexKeyOf(entry.Path))
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// the url of a cache file or git repo in scoopCache("buckets"), or else key itself (e.g. a local bucket's path)
+func cacheKeyUrl(key string) string {
+	bucketsDir := scoopCache("buckets") + string(filepath.Separator)
+	if !strings.HasPrefix(key, bucketsDir) {
+		return key
+	}
+	name := strings.TrimPrefix(key, bucketsDir)
+	if _, ok := g_CacheKindsByExt[filepath.Ext(name)]; ok {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	if url, err := net_url.QueryUnescape(name); err == nil {
+		return url
+	}
+	return key
+}
+
+func dirSize(path string) (size int64) {
+	filepath.WalkDir(path, func(_ string, dirEntry fs.DirEntry, err error) error {
+		if err == nil && !dirEntry.IsDir() {
+			if info, err := dirEntry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// deletes a cache entry with its sidecar.  git marks its objects read-only, which RemoveAll can't delete on windows
+func (entry *CacheEntry) remove() error {
+	err := os.RemoveAll(entry.Path)
+	if err != nil {
+		filepath.WalkDir(entry.Path, func(path string, _ fs.DirEntry, _ error) error {
+			os.Chmod(path, 0700)
+			return nil
+		})
+		err = os.RemoveAll(entry.Path)
+	}
+	os.Remove(cacheMetaPath(entry.Path))
+	return err
+}
+
+func cacheList() error {
+	entries, err := loadCacheEntries()
+	if err != nil {
+		return err
+	}
+
+	// most recently used first
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.After(entries[j].LastUsed) })
+
+	now := time.Now()
+	var total int64
+	fmt.Printf(colorize("source.header", "%-14s %9s %6s %9s  %s\n"), "KIND", "SIZE", "AGE", "LAST USED", "URL")
+	for _, entry := range entries {
+		total += entry.Size
+		fmt.Printf("%-14s %9s %6s %9s  %s\n", entry.Kind, fmtSize(entry.Size), fmtDuration(now.Sub(entry.Modified)), fmtDuration(now.Sub(entry.LastUsed)), entry.Url)
+	}
+	fmt.Printf(colorize("totals", "\nTOTAL: %d entries, %s in %s and %s\n"), len(entries), fmtSize(total), scoopCache("buckets"), scoopCache("index"))
+	return nil
+}
+
+func cacheClear(pattern string) error {
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return fmt.Errorf("bad pattern: %w", err)
+	}
+
+	entries, err := loadCacheEntries()
+	if err != nil {
+		return err
+	}
+
+	var freed int64
+	count := 0
+	for _, entry := range entries {
+		if !re.MatchString(entry.Url) {
+			continue
+		}
+		if err := entry.remove(); err != nil {
+			fmt.Printf(colorize("error", "*** %s\n"), err)
+			continue
+		}
+		fmt.Printf("deleted %s %s\n", fmtSize(entry.Size), entry.Url)
+		freed += entry.Size
+		count += 1
+	}
+	fmt.Printf(colorize("totals", "\nDELETED: %d entries, %s\n"), count, fmtSize(freed))
+	return nil
+}
+
+func cachePrune(olderThan string, maxSize string) (err error) {
+	var maxAge time.Duration
+	if olderThan != "" {
+		if maxAge, err = parseAge(olderThan); err != nil {
+			return
+		}
+	}
+	var maxBytes int64 = -1
+	if maxSize != "" {
+		if maxBytes, err = parseSize(maxSize); err != nil {
+			return
+		}
+	}
+	if olderThan == "" && maxSize == "" {
+		return fmt.Errorf("prune needs -older-than and/or -max-size")
+	}
+
+	entries, err := loadCacheEntries()
+	if err != nil {
+		return
+	}
+
+	// least recently used first
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.Before(entries[j].LastUsed) })
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	now := time.Now()
+	var freed int64
+	count := 0
+	for _, entry := range entries {
+		tooOld := olderThan != "" && now.Sub(entry.LastUsed) > maxAge
+		tooBig := maxBytes >= 0 && total > maxBytes
+		if !tooOld && !tooBig {
+			continue
+		}
+		if err := entry.remove(); err != nil {
+			fmt.Printf(colorize("error", "*** %s\n"), err)
+			continue
+		}
+		fmt.Printf("deleted %s, last used %s ago: %s\n", fmtSize(entry.Size), fmtDuration(now.Sub(entry.LastUsed)), entry.Url)
+		total -= entry.Size
+		freed += entry.Size
+		count += 1
+	}
+
+	// leftovers from interrupted downloads and index saves, and sidecars without their cache
+	for _, cacheDir := range []string{scoopCache("buckets"), scoopCache("index")} {
+		dirEntries, _ := os.ReadDir(cacheDir)
+		for _, dirEntry := range dirEntries {
+			path := filepath.Join(cacheDir, dirEntry.Name())
+			switch {
+			case strings.HasSuffix(path, ".tmp"):
+				os.Remove(path)
+			case strings.HasSuffix(path, ".meta"):
+				if _, err := os.Stat(strings.TrimSuffix(path, ".meta")); os.IsNotExist(err) {
+					os.Remove(path)
+				}
+			}
+		}
+	}
+
+	fmt.Printf(colorize("totals", "\nPRUNED: %d entries, %s.  %s remaining\n"), count, fmtSize(freed), fmtSize(total))
+	return nil
+}
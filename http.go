@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	net_url "net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//=========================================================
+// HTTP client for downloads
+//=========================================================
+
+// -connect-timeout: for connecting to a server, including the TLS handshake
+var g_HttpConnectTimeout = 10 * time.Second
+
+// -read-timeout: for the response headers, and then for each read of the body (so a slow but live download isn't cut off)
+var g_HttpReadTimeout = 30 * time.Second
+
+// -retries: the number of times a request is retried after a 5xx response, a reset connection, or a timeout
+var g_HttpRetries = 3
+
+// the first retry waits about this long, and each retry after it twice as long as the one before
+var g_HttpRetryBackoff = time.Second
+
+// Retry-After is honored up to this long
+const g_HttpMaxRetryWait = 2 * time.Minute
+
+func newHttpClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   g_HttpConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = g_HttpConnectTimeout
+	transport.ResponseHeaderTimeout = g_HttpReadTimeout
+
+	transport.Proxy = func(request *http.Request) (*net_url.URL, error) {
+		return proxyForUrl(request.URL)
+	}
+	// each host gets its own client certificate and verification, see tls.go
+	return &http.Client{Transport: newHostTransport(transport)}
+}
+
+// sends the request, retrying with a jittered exponential backoff after a 5xx/429 response, a reset connection, or a timeout.
+// handle reads the response and is retried too if reading its body fails that way.
+// After the last attempt, the 5xx/429 response is given to handle.
+func httpDo(out io.Writer, cli *http.Client, request *http.Request, handle func(response *http.Response) error) (err error) {
+	for attempt := 0; ; attempt++ {
+		last := attempt >= g_HttpRetries
+		if DEBUG {
+			fmt.Fprintf(out, colorize("debug", "HTTP")+": %s %s (attempt %d/%d)\n", request.Method, request.URL, attempt+1, g_HttpRetries+1)
+		}
+
+		var wait time.Duration
+		wait, err = httpAttempt(out, cli, request, handle, last)
+		if err == nil || last || wait < 0 {
+			return
+		}
+
+		if wait == 0 {
+			wait = retryBackoff(attempt)
+		}
+		if DEBUG {
+			fmt.Fprintf(out, colorize("debug", "HTTP")+": %s, retrying in %s\n", err, wait.Round(time.Millisecond))
+		}
+		time.Sleep(wait)
+	}
+}
+
+// makes one attempt.  wait is < 0 if err shouldn't be retried, or else the server's Retry-After (0 if none)
+func httpAttempt(out io.Writer, cli *http.Client, request *http.Request, handle func(response *http.Response) error, last bool) (wait time.Duration, err error) {
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+
+	response, err := cli.Do(request.Clone(ctx))
+	if err != nil {
+		if isRetryableHttpError(err) {
+			return 0, err
+		}
+		return -1, err
+	}
+	defer response.Body.Close()
+
+	if DEBUG {
+		fmt.Fprintf(out, colorize("debug", "HTTP")+": %s\n", response.Status)
+	}
+
+	if !last && (response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests) {
+		return retryAfter(response), fmt.Errorf("%s: %s", request.URL, response.Status)
+	}
+
+	body := newIdleTimeoutReader(response.Body, g_HttpReadTimeout, cancel)
+	defer body.Stop()
+	response.Body = body
+
+	err = handle(response)
+	if err != nil && (body.timedOut.Load() || isRetryableHttpError(err)) {
+		return 0, err
+	}
+	return -1, err
+}
+
+// connection resets, unexpected EOFs and timeouts are worth retrying
+func isRetryableHttpError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, errIdleTimeout) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// full jitter: between half and all of the exponential backoff, which is at most g_HttpMaxRetryWait
+func retryBackoff(attempt int) time.Duration {
+	// doubled one attempt at a time, since shifting by a large -retries overflows
+	backoff := g_HttpRetryBackoff
+	for i := 0; i < attempt && backoff < g_HttpMaxRetryWait; i++ {
+		backoff *= 2
+	}
+	backoff = MinDuration(backoff, g_HttpMaxRetryWait)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// the wait asked for by a Retry-After header of seconds or an http date, or 0 if none
+func retryAfter(response *http.Response) (wait time.Duration) {
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+	}
+	return MaxDuration(0, MinDuration(wait, g_HttpMaxRetryWait))
+}
+
+//---------------------------------------------------------
+// the output of a request's source, for what its transport prints (see SourceOutput)
+//---------------------------------------------------------
+
+type outputContextKey struct{}
+
+func withOutput(ctx context.Context, out io.Writer) context.Context {
+	return context.WithValue(ctx, outputContextKey{}, out)
+}
+
+// the output in ctx, or else stdout
+func outputOf(ctx context.Context) io.Writer {
+	if out, ok := ctx.Value(outputContextKey{}).(io.Writer); ok {
+		return out
+	}
+	return os.Stdout
+}
+
+//=========================================================
+// idleTimeoutReader: cancels a download that stops sending data
+//=========================================================
+
+var errIdleTimeout = errors.New("download timed out")
+
+type idleTimeoutReader struct {
+	body     io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func newIdleTimeoutReader(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutReader {
+	reader := &idleTimeoutReader{body: body, timeout: timeout}
+	reader.timer = time.AfterFunc(timeout, func() {
+		reader.timedOut.Store(true)
+		cancel()
+	})
+	return reader
+}
+
+func (reader *idleTimeoutReader) Read(p []byte) (n int, err error) {
+	n, err = reader.body.Read(p)
+	if reader.timedOut.Load() {
+		return n, fmt.Errorf("%w: no data for %s", errIdleTimeout, reader.timeout)
+	}
+	reader.timer.Reset(reader.timeout)
+	return
+}
+
+func (reader *idleTimeoutReader) Close() error {
+	reader.Stop()
+	return reader.body.Close()
+}
+
+func (reader *idleTimeoutReader) Stop() {
+	reader.timer.Stop()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+//=========================================================
+// INDEX: the parsed apps of each bucket, saved under scoopCache("index")
+//=========================================================
+
+// bump whenever AppInfo or IndexEntry change, so older indexes are parsed again
+const g_IndexVersion = 4
+
+// -index: use the saved index of each bucket instead of parsing its manifests again
+var g_UseIndex = true
+
+// IndexEntry is the parsed apps of one bucket, or of one source file of many buckets
+type IndexEntry struct {
+	Version  int
+	Key      string // the bucket's path, or the source's (cache) file
+	Revision string // the git commit, or the file/folder's time and size, that the apps were parsed from
+	Buckets  BucketMap
+	Trigrams map[string]*TrigramIndex // by bucket
+}
+
+func indexPath(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(scoopCache("index"), hex.EncodeToString(hash[:16])+".gob")
+}
+
+// loads the index of key, if it is of the same version and revision
+func loadIndexEntry(out io.Writer, key string, revision string) *IndexEntry {
+	file, err := os.Open(indexPath(key))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	entry := &IndexEntry{}
+	if err := gob.NewDecoder(file).Decode(entry); err != nil {
+		if DEBUG {
+			fmt.Fprintf(out, colorize("debug", "INDEX")+": ignoring %s: %s\n", key, err)
+		}
+		return nil
+	}
+	if entry.Version != g_IndexVersion || entry.Key != key || entry.Revision != revision {
+		return nil
+	}
+	return entry
+}
+
+// the key of an index file, skipping its apps
+func indexKeyOf(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	var header struct{ Key string }
+	gob.NewDecoder(file).Decode(&header)
+	return header.Key
+}
+
+func (entry *IndexEntry) save() error {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(entry); err != nil {
+		return err
+	}
+	return writeFileAtomic(indexPath(entry.Key), &body, nil)
+}
+
+// returns the buckets of key from its index if revision is unchanged, otherwise loads and indexes them.
+// An empty revision means it couldn't be determined, so the buckets are always loaded.  Their trigrams are indexed either way.
+func indexedBuckets(out io.Writer, key string, revision string, load func() (BucketMap, error)) (buckets BucketMap, err error) {
+	if !g_UseIndex || revision == "" {
+		buckets, err = load()
+		registerTrigramIndexes(buckets)
+		return
+	}
+
+	if entry := loadIndexEntry(out, key, revision); entry != nil {
+		// for `cache prune`, an index was last used when its file was changed
+		now := time.Now()
+		os.Chtimes(indexPath(key), now, now)
+		if DEBUG {
+			fmt.Fprintf(out, colorize("debug", "INDEX")+": using %s at %s\n", key, revision)
+		}
+		for bucket, apps := range entry.Buckets {
+			registerTrigramIndex(apps, entry.Trigrams[bucket])
+		}
+		return entry.Buckets, nil
+	}
+
+	buckets, err = load()
+	if err != nil {
+		return
+	}
+
+	entry := &IndexEntry{Version: g_IndexVersion, Key: key, Revision: revision, Buckets: buckets, Trigrams: map[string]*TrigramIndex{}}
+	for bucket, apps := range buckets {
+		if len(apps) > 0 {
+			entry.Trigrams[bucket] = buildTrigramIndex(apps)
+			registerTrigramIndex(apps, entry.Trigrams[bucket])
+		}
+	}
+	if err := entry.save(); err != nil {
+		fmt.Fprintf(out, colorize("error", "*** Couldn't save index of %s: %s\n"), key, err)
+	}
+	return
+}
+
+// like indexedBuckets, for a single bucket
+func indexedAppList(out io.Writer, key string, revision string, load func() (AppList, error)) (appList AppList, err error) {
+	buckets, err := indexedBuckets(out, key, revision, func() (BucketMap, error) {
+		appList, err := load()
+		return BucketMap{"": appList}, err
+	})
+	return buckets[""], err
+}
+
+// a file changes when its time or size does
+func fileRevision(path string) string {
+	f, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return "file:" + strconv.FormatInt(f.ModTime().UnixNano(), 10) + ":" + strconv.FormatInt(f.Size(), 10)
+}
+
+// a downloaded file changes when its hash does, since revalidating it changes its time.
+// Other files (without a sidecar) change with their time or size.
+func cacheRevision(path string) string {
+	if meta := loadCacheMeta(path); meta != nil && meta.Sha256 != "" {
+		return "sha256:" + meta.Sha256 + ":" + strconv.FormatInt(meta.Size, 10)
+	}
+	return fileRevision(path)
+}
+
+// a local bucket changes with its git HEAD, or else with the time of its manifests folder
+func dirRevision(path string) string {
+	if repo, err := git.PlainOpen(path); err == nil {
+		if head, err := repo.Head(); err == nil {
+			return "git:" + head.Hash().String()
+		}
+	}
+
+	var revision []string
+	for _, dir := range []string{path, filepath.Join(path, "bucket")} {
+		if f, err := os.Stat(dir); err == nil {
+			revision = append(revision, "dir:"+strconv.FormatInt(f.ModTime().UnixNano(), 10))
+		}
+	}
+	return strings.Join(revision, ";")
+}
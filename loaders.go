@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// SourceLoader loads the buckets of one kind of source.
+// New source kinds are added by calling registerSourceLoader() from an init() function.
+type SourceLoader interface {
+	// the kind used in the "[kind]" part of a source, e.g. "html"
+	Kind() string
+	// reports whether this loader handles the source, either by its explicit kind or by sniffing its path/url
+	Match(src *SourceRef) bool
+	// loads the source's buckets, printing any status to out
+	Load(src *SourceRef, out io.Writer) (BucketMap, error)
+	// one line description shown by -help
+	Describe() string
+}
+
+// registered loaders in the order they are consulted.  The first match wins.
+var g_SourceLoaders []SourceLoader
+
+// catch-all loaders (e.g. any url, any path) that are consulted after all others, regardless of init() order
+var g_FallbackSourceLoaders []SourceLoader
+
+func registerSourceLoader(loader SourceLoader) {
+	g_SourceLoaders = append(g_SourceLoaders, loader)
+}
+
+func registerFallbackSourceLoader(loader SourceLoader) {
+	g_FallbackSourceLoaders = append(g_FallbackSourceLoaders, loader)
+}
+
+func allSourceLoaders() []SourceLoader {
+	return append(append([]SourceLoader{}, g_SourceLoaders...), g_FallbackSourceLoaders...)
+}
+
+// finds the first registered loader that matches the source
+func findSourceLoader(src *SourceRef) SourceLoader {
+	for _, loader := range allSourceLoaders() {
+		if loader.Match(src) {
+			return loader
+		}
+	}
+	return nil
+}
+
+// the kind of the loader that matches the source, or "" if none do
+func sourceLoaderKindOf(src *SourceRef) string {
+	if loader := findSourceLoader(src); loader != nil {
+		return loader.Kind()
+	}
+	return ""
+}
+
+// the unique kinds of all registered loaders, joined by sep
+func sourceLoaderKinds(sep string) string {
+	var kinds []string
+	seen := map[string]bool{}
+	for _, loader := range allSourceLoaders() {
+		kind := loader.Kind()
+		if !seen[kind] {
+			seen[kind] = true
+			kinds = append(kinds, kind)
+		}
+	}
+	return strings.Join(kinds, sep)
+}
+
+// the registered kinds as a regexp alternation for g_SourceFormatRE
+func sourceLoaderKindsRE() string {
+	var kinds []string
+	for _, kind := range strings.Split(sourceLoaderKinds("|"), "|") {
+		kinds = append(kinds, regexp.QuoteMeta(kind))
+	}
+	return strings.Join(kinds, "|")
+}
+
+// describes the registered loaders for -help
+func describeSourceLoaders() string {
+	var desc strings.Builder
+	for _, loader := range allSourceLoaders() {
+		desc.WriteString(fmt.Sprintf("  [%s] %s\n", loader.Kind(), loader.Describe()))
+	}
+	return desc.String()
+}
+
+// an empty kind, or "bucket", means the loader is picked by sniffing the path/url
+func (src *SourceRef) isAutoKind() bool {
+	return src.Kind == "" || src.Kind == "bucket"
+}
+
+//=========================================================
+// sourceLoader: a SourceLoader built from functions
+//=========================================================
+
+type sourceLoader struct {
+	kind        string
+	description string
+	match       func(src *SourceRef) bool
+	load        func(src *SourceRef, out io.Writer) (BucketMap, error)
+}
+
+func (loader *sourceLoader) Kind() string {
+	return loader.kind
+}
+
+func (loader *sourceLoader) Match(src *SourceRef) bool {
+	return loader.match(src)
+}
+
+func (loader *sourceLoader) Load(src *SourceRef, out io.Writer) (BucketMap, error) {
+	return loader.load(src, out)
+}
+
+func (loader *sourceLoader) Describe() string {
+	return loader.description
+}
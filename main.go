@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/exp/slices"
@@ -16,9 +21,7 @@ import (
 	"github.com/valyala/fastjson"
 	////"github.com/pkg/profile"
 	//"github.com/mmcloughlin/profile"
-	//_ "github.com/mattn/go-sqlite3"
 	//_ "github.com/pocketbase/dbx"
-	// _ "github.com/mutecomm/go-sqlcipher/v4"
 )
 
 var g_Version = "v0.1.20240202"
@@ -32,6 +35,7 @@ type SourceRef struct {
 	Cond string
 	Kind string
 	Path string
+	Ref  string // git branch, tag, or commit given as path@ref
 }
 
 type SourceRefs []SourceRef
@@ -42,6 +46,32 @@ type AppInfo struct {
 	Description string
 	Homepage    string
 	Bins        []string
+	// the rest are only known from manifests, not from html, markdown or sqlite sources
+	License       string // the spdx identifier, or the url of a license without one
+	LicenseUrl    string
+	Notes         string // lines joined by "\n"
+	Depends       []string
+	Suggest       map[string][]string // feature: apps, any of which provides it
+	Shortcuts     []AppShortcut
+	EnvAddPath    []string
+	Persist       []string
+	Urls          []string
+	Hashes        []string
+	Architectures map[string]*AppArchitecture // 64bit, 32bit, arm64
+	HasCheckver   bool
+	HasAutoupdate bool
+}
+
+// the parts of a manifest that differ by architecture
+type AppArchitecture struct {
+	Urls   []string
+	Hashes []string
+	Bins   []string
+}
+
+type AppShortcut struct {
+	Target string
+	Name   string
 }
 
 type AppList = []*AppInfo
@@ -49,12 +79,13 @@ type BucketMap = map[string]AppList
 type NameSourceMap = map[string]string
 
 type BucketsMatch struct {
-	Buckets BucketMap
-	NumApps int
+	Buckets    BucketMap
+	NumApps    int
+	NumBuckets int // the number of buckets searched
 }
 
 func NewBucketsMatch() *BucketsMatch {
-	return &BucketsMatch{make(BucketMap), 0}
+	return &BucketsMatch{make(BucketMap), 0, 0}
 }
 
 type SearchState struct {
@@ -66,6 +97,15 @@ type SearchState struct {
 	// Each Source has a corresponding BucketsMatch here:
 	MatchList     []*BucketsMatch
 	NumAppMatches int
+
+	// the sources that failed, in order
+	Failures []SourceFailure
+}
+
+type SourceFailure struct {
+	Index  int // of the source, from 1
+	Source *SourceRef
+	Err    error
 }
 
 type ScoopConfig struct {
@@ -77,6 +117,9 @@ type ScoopConfig struct {
 	ScoopGlobalDir  string // $env:SCOOP_GLOBAL, (get_config 'globalPath'), "$env:ProgramData\scoop"
 	ScoopCacheDir   string // $env:SCOOP_CACHE, (get_config 'cachePath'), "$scoopdir\cache"
 	ScoopProxy      string
+	Offline         bool // scoop config scoops_offline
+	TLS             TLSOptions
+	Auth            AuthMap
 	NamedSourceRefs map[string]SourceRef
 }
 
@@ -84,23 +127,68 @@ var DEBUG bool
 var g_State = new(SearchState)
 var g_Config = new(ScoopConfig)
 
-// load and search (filter) the given source, returning filtered bucket matches and the total number of app matches in those buckets
-func (state *SearchState) SearchSource(src *SourceRef) (match *BucketsMatch, err error) {
+// load and search (filter) the given source, returning filtered bucket matches and the total number of app matches in those buckets.
+// When some of a source's buckets fail, the others are still matched and returned along with the error.
+// What the loaders print goes to out.  This is safe to call concurrently for different sources.
+func (state *SearchState) SearchSource(src *SourceRef, out io.Writer) (match *BucketsMatch, err error) {
+	// a panic in a loader only fails its own source
+	defer func() {
+		if r := recover(); r != nil {
+			match, err = nil, fmt.Errorf("unable to get buckets from source: %s: %v", src.Location(), r)
+		}
+	}()
+
 	// load buckets based upon type of source
-	buckets, err := loadBucketsFrom(src.Kind, src.Path)
+	buckets, err := loadBucketsFrom(src, out)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get buckets from source: %s", src)
+		// keep any buckets that did load
+		for name, apps := range buckets {
+			if apps == nil {
+				delete(buckets, name)
+			}
+		}
+		// offline, the source is only skipped if none of it is cached
+		if len(buckets) == 0 && errors.Is(err, ErrOfflineNoCache) {
+			return nil, err
+		}
+		err = fmt.Errorf("unable to get buckets from source: %s: %w", src.Location(), err)
+		if len(buckets) == 0 {
+			return nil, err
+		}
 	}
 
 	match = filterBuckets(state.Query, buckets)
 	match.Buckets = renameBucketsToKnownNames(match.Buckets, "/")
+	match.NumBuckets = len(buckets)
+
+	return match, err
+}
+
+// the result of searching one source in the background
+type sourceSearch struct {
+	match  *BucketsMatch
+	err    error
+	output SourceOutput
+	done   chan struct{}
+}
 
-	fmt.Printf(colorize("source.summary", "- %d apps matched in %d/%d buckets\n\n"), match.NumApps, len(match.Buckets), len(buckets))
+// what a source's loaders print, kept until the source's section is printed.
+// A source's buckets load concurrently, so it is safe to write to concurrently
+type SourceOutput struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
 
-	state.MatchList = append(state.MatchList, match)
-	state.NumAppMatches += match.NumApps
+func (output *SourceOutput) Write(p []byte) (int, error) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	return output.buffer.Write(p)
+}
 
-	return match, nil
+func (output *SourceOutput) WriteTo(w io.Writer) (int64, error) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	return output.buffer.WriteTo(w)
 }
 
 func (state *SearchState) Run(args *ParsedArgs) error {
@@ -122,7 +210,9 @@ func (state *SearchState) Run(args *ParsedArgs) error {
 		fmt.Printf(colorize("debug", "SOURCES")+": %v\n", state.Sources)
 		fmt.Printf(colorize("debug", " COLORS")+": %v\n", state.Args.colors.StringAll(true))
 
-		if b, err := json.Marshal(g_Config); err == nil {
+		config := *g_Config
+		config.ScoopProxy = redactProxy(config.ScoopProxy)
+		if b, err := json.Marshal(config); err == nil {
 			fmt.Printf(colorize("debug", " CONFIG")+": %s\n", string(b))
 		} else {
 			fmt.Println(err)
@@ -135,16 +225,67 @@ func (state *SearchState) Run(args *ParsedArgs) error {
 		//}
 	}
 
+	// the proxy and TLS options are loaded first, so any warnings about them aren't in a source's section
+	loadProxyConfig()
+	loadTLSOptions()
+
+	// sources are loaded and filtered concurrently, but their results (and what their loaders print) are printed in order
+	searches := make([]*sourceSearch, len(state.Sources))
+	startSearch := func(index int) {
+		search := &sourceSearch{done: make(chan struct{})}
+		searches[index] = search
+		go func(src *SourceRef) {
+			defer close(search.done)
+			search.match, search.err = state.SearchSource(src, &search.output)
+		}(&state.Sources[index])
+	}
+
+	// an if0 source is only started once all of the previous sources have finished (see below)
 	for index, src := range state.Sources {
-		if src.Cond == "if0" && state.NumAppMatches > 0 {
-			continue
+		if src.Cond != "if0" {
+			startSearch(index)
+		}
+	}
+
+	for index, src := range state.Sources {
+		if src.Cond == "if0" {
+			// every previous source has finished, so their matches are all counted
+			if state.NumAppMatches > 0 {
+				continue
+			}
+			startSearch(index)
 		}
+		search := searches[index]
+		<-search.done
 
 		fmt.Print(divider)
-		fmt.Printf(colorize("source.header", "#%d Searching %s [%s] %s\n"), index+1, src.Cond, src.Kind, src.Path)
+		header := fmt.Sprintf("#%d Searching %s [%s] %s", index+1, src.Cond, src.Kind, src.Location())
+		if age, ok := cacheAgeOf(src.Path); ok {
+			header += fmt.Sprintf(" (%s old cache)", fmtDuration(age))
+		}
+		fmt.Println(colorize("source.header", header))
+		search.output.WriteTo(os.Stdout)
 
-		match, _ := state.SearchSource(&src)
+		if search.match == nil && errors.Is(search.err, ErrOfflineNoCache) {
+			fmt.Printf(colorize("source.status", "- skipped: %s\n\n"), search.err)
+			continue
+		}
 		state.NumSourcesSearched += 1
+
+		if search.err != nil {
+			fmt.Printf(colorize("error", "*** %s\n\n"), indentLines(search.err.Error(), "    "))
+			state.Failures = append(state.Failures, SourceFailure{index + 1, &state.Sources[index], search.err})
+			if search.match == nil {
+				continue
+			}
+		}
+
+		match := search.match
+		fmt.Printf(colorize("source.summary", "- %d apps matched in %d/%d buckets\n\n"), match.NumApps, len(match.Buckets), match.NumBuckets)
+
+		state.MatchList = append(state.MatchList, match)
+		state.NumAppMatches += match.NumApps
+
 		if !merge {
 			printResults(match.Buckets, args.linelen)
 		}
@@ -157,7 +298,9 @@ func (state *SearchState) Run(args *ParsedArgs) error {
 	}
 
 	fmt.Print(divider)
-	fmt.Printf(colorize("totals", "TOTAL: %d apps matched in %d buckets from %d sources\n\n"), state.NumAppMatches, numBuckets, state.NumSourcesSearched)
+	fmt.Printf(colorize("totals", "TOTAL: %d apps matched in %d buckets from %d sources\n"), state.NumAppMatches, numBuckets, state.NumSourcesSearched)
+	state.printFailures()
+	fmt.Println()
 
 	if merge {
 		fmt.Printf("MERGED RESULTS:\n\n")
@@ -174,6 +317,22 @@ func (state *SearchState) Run(args *ParsedArgs) error {
 	return nil
 }
 
+// summarizes the failed sources under the totals
+func (state *SearchState) printFailures() {
+	if len(state.Failures) == 0 {
+		return
+	}
+	plural := "s"
+	if len(state.Failures) == 1 {
+		plural = ""
+	}
+	fmt.Printf(colorize("error", "%d source%s failed:\n"), len(state.Failures), plural)
+	for _, failure := range state.Failures {
+		prefix := fmt.Sprintf("  #%d ", failure.Index)
+		fmt.Printf(colorize("error", "%s%s\n"), prefix, indentLines(failure.Err.Error(), strings.Repeat(" ", len(prefix))))
+	}
+}
+
 //func debug(arg ...interface{}) {
 //	if DEBUG {
 //		fmt.Println(arg...) // forward it here
@@ -228,6 +387,7 @@ func loadScoopConfig() (err error) {
 	//	"SCOOP_REPO": "https://github.com/ScoopInstaller/Scoop",
 	//	"SCOOP_BRANCH": "master"
 	//}
+	var ghToken, authConfig string
 	body, err := os.ReadFile(g_Config.ScoopConfigFile)
 	if err == nil && len(body) > 0 {
 		var parser fastjson.Parser
@@ -236,12 +396,34 @@ func loadScoopConfig() (err error) {
 		g_Config.ScoopGlobalDir = string(js.GetStringBytes("global_path"))
 		g_Config.ScoopCacheDir = string(js.GetStringBytes("cache_path"))
 		g_Config.ScoopProxy = string(js.GetStringBytes("proxy"))
+		if value := js.Get("scoops_offline"); value != nil {
+			g_Config.Offline = value.Type() == fastjson.TypeTrue || strings.EqualFold(string(value.GetStringBytes()), "true")
+		}
+		ghToken = string(js.GetStringBytes("gh_token"))
+		authConfig = configList(js, "scoops_auth")
+		g_Config.TLS.CAFiles.Set(configList(js, "scoops_ca_files"))
+		g_Config.TLS.InsecureHosts.Set(configList(js, "scoops_insecure_hosts"))
+		if err := g_Config.TLS.ClientCerts.Set(configList(js, "scoops_client_certs")); err != nil {
+			fmt.Printf(colorize("error", "*** Ignoring scoops_client_certs config: %s\n"), err)
+		}
 		if DEBUG {
 			fmt.Printf("Loaded ScoopConfigFile=%s\n", g_Config.ScoopConfigFile)
 			fmt.Printf("ScoopDir=%s\n", g_Config.ScoopDir)
 		}
 	}
 
+	// like scoop, $env:SCOOP_GH_TOKEN overrides gh_token.  $env:SCOOPS_AUTH is added after (and so overrides) scoops_auth
+	if value := os.Getenv("SCOOP_GH_TOKEN"); value != "" {
+		ghToken = value
+	}
+	g_Config.Auth.addGitHubToken(ghToken)
+	if err := g_Config.Auth.Set(authConfig); err != nil {
+		fmt.Printf(colorize("error", "*** Ignoring scoops_auth config: %s\n"), err)
+	}
+	if err := g_Config.Auth.Set(os.Getenv("SCOOPS_AUTH")); err != nil {
+		fmt.Printf(colorize("error", "*** Ignoring $env:SCOOPS_AUTH: %s\n"), err)
+	}
+
 	// https://github.com/42wim/scoop-bucket/blob/master/.appveyor.yml
 	// environment:
 	// 	 SCOOP: C:\projects\scoop
@@ -303,8 +485,8 @@ func loadScoopConfig() (err error) {
 	g_Config.NamedSourceRefs = map[string]SourceRef{}
 
 	// must be after loading config
-	g_Config.NamedSourceRefs["active"] = SourceRef{"", "buckets", filepath.Join(g_Config.ScoopDir, "buckets")}
-	g_Config.NamedSourceRefs["rasa"] = SourceRef{"", "html", "https://rasa.github.io/scoop-directory/by-score.html"}
+	g_Config.NamedSourceRefs["active"] = SourceRef{"", "buckets", filepath.Join(g_Config.ScoopDir, "buckets"), ""}
+	g_Config.NamedSourceRefs["rasa"] = SourceRef{"", "html", "https://rasa.github.io/scoop-directory/by-score.html", ""}
 	//	"rasa":   {"if0", "html", "https://rasa.github.io/scoop-directory/by-score.html"},
 
 	//fmt.Println(g_Config)
@@ -312,6 +494,28 @@ func loadScoopConfig() (err error) {
 	return
 }
 
+// a config value that is a ";" separated string, an array of strings, or an object of key=value strings, as a ";" separated string
+func configList(js *fastjson.Value, key string) string {
+	value := js.Get(key)
+	if value == nil {
+		return ""
+	}
+	var list []string
+	switch value.Type() {
+	case fastjson.TypeArray:
+		for _, item := range value.GetArray() {
+			list = append(list, string(item.GetStringBytes()))
+		}
+	case fastjson.TypeObject:
+		value.GetObject().Visit(func(key []byte, item *fastjson.Value) {
+			list = append(list, string(key)+"="+string(item.GetStringBytes()))
+		})
+	default:
+		return string(value.GetStringBytes())
+	}
+	return strings.Join(list, ";")
+}
+
 func timeTrack(start time.Time, name string) {
 	elapsed := time.Since(start)
 	log.Printf("%s took %s\n", name, elapsed)
@@ -335,6 +539,11 @@ func main() {
 
 	initColorize()
 
+	// `scoops cache list|clear|prune` manages the downloads cache instead of searching.  `scoops cache` still searches for "cache"
+	if len(os.Args) > 2 && os.Args[1] == "cache" && isCacheCommand(os.Args[2]) {
+		os.Exit(runCacheCommand(os.Args[2:]))
+	}
+
 	args := parseArgs()
 	mergeColorMap(args.colors)
 
@@ -352,24 +561,107 @@ func main() {
 	}
 }
 
+//=========================================================
+// ARCH: the architecture whose bins are matched and shown
+//=========================================================
+
+// -arch: 64bit, 32bit, arm64, or all
+var g_Arch = hostArch()
+
+// like scoop, an app without the host's architecture uses the next one the host can run
+var g_ArchFallbacks = map[string][]string{
+	"64bit": {"64bit", "32bit"},
+	"32bit": {"32bit"},
+	"arm64": {"arm64", "64bit", "32bit"},
+}
+
+// a bin of an app, and the architecture it is only for ("" for all of them)
+type ArchBin struct {
+	Bin  string
+	Arch string
+}
+
+// the architecture of windows, even for a 32bit or emulated exe, or else of this exe
+func hostArch() string {
+	arch := getenvAny("PROCESSOR_ARCHITEW6432", "PROCESSOR_ARCHITECTURE")
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	switch strings.ToLower(arch) {
+	case "x86", "386":
+		return "32bit"
+	case "arm64":
+		return "arm64"
+	}
+	return "64bit"
+}
+
+func validArch(arch string) bool {
+	_, ok := g_ArchFallbacks[arch]
+	return ok || arch == "all"
+}
+
+// the top-level bins, then those of the first architecture for arch that the app has, or of every architecture for "all"
+func (app *AppInfo) binsForArch(arch string) (bins []ArchBin) {
+	for _, bin := range app.Bins {
+		bins = append(bins, ArchBin{Bin: bin})
+	}
+
+	if arch == "all" {
+		names := make([]string, 0, len(app.Architectures))
+		for name := range app.Architectures {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, bin := range app.Architectures[name].Bins {
+				bins = append(bins, ArchBin{Bin: bin, Arch: name})
+			}
+		}
+		return
+	}
+
+	for _, name := range g_ArchFallbacks[arch] {
+		if architecture, ok := app.Architectures[name]; ok {
+			for _, bin := range architecture.Bins {
+				bins = append(bins, ArchBin{Bin: bin, Arch: name})
+			}
+			break
+		}
+	}
+	return
+}
+
 // Search by filtering apps and buckets
 func filterApp(query *SearchQuery, app *AppInfo) bool {
 	found := false
+	nameMatched := false
 	//	if strings.Contains(strings.ToLower(app.name), opt) {
 	for _, field := range query.Fields {
 		switch field {
 		case "name":
 			if query.Pattern.MatchString(app.Name) {
 				app.Bins = nil // ignore bin if name matches
+				nameMatched = true
 				found = true
 			}
 		case "bins":
+			// including the bins of each architecture
+			if nameMatched {
+				continue
+			}
 			var bins []string
-			for _, bin := range app.Bins {
-				bin = filepath.Base(bin)
+			for _, bin := range app.binsForArch(g_Arch) {
 				//			if strings.Contains(strings.ToLower(strings.TrimSuffix(bin, filepath.Ext(bin))), opt) {
-				if query.Pattern.MatchString(strings.TrimSuffix(bin, filepath.Ext(bin))) {
-					bins = append(bins, bin)
+				if query.Pattern.MatchString(binSearchText(bin.Bin)) {
+					shown := filepath.Base(bin.Bin)
+					// with -arch all, a bin of one architecture is tagged with it
+					if g_Arch == "all" && bin.Arch != "" {
+						shown += " (" + bin.Arch + ")"
+					}
+					if !slices.Contains(bins, shown) {
+						bins = append(bins, shown)
+					}
 					found = true
 				}
 			}
@@ -385,7 +677,12 @@ func filterApp(query *SearchQuery, app *AppInfo) bool {
 
 func filterAppList(query *SearchQuery, apps AppList) (matches AppList) {
 	matches = AppList{}
-	for _, app := range apps {
+	// the trigram index rules out most apps without running the regexp
+	candidates := trigramCandidates(query, apps)
+	for i, app := range apps {
+		if candidates != nil && !candidates[i] {
+			continue
+		}
 		if filterApp(query, app) {
 			matches = append(matches, app)
 		}
@@ -422,7 +719,8 @@ func renameBucketsToKnownNames(buckets BucketMap, prefix string) (res BucketMap)
 
 	// load known bucket name:source from buckets.json
 	bucketsJsonFile := filepath.Join(g_Config.ScoopDir, "apps", "scoop", "current", "buckets.json")
-	bucketsByName := loadNameSourceMapFromJsonFile(bucketsJsonFile)
+	// without a buckets.json, no names are known
+	bucketsByName, _ := loadNameSourceMapFromJsonFile(bucketsJsonFile)
 	bucketsBySource := map[string]string{}
 
 	// create a reverse map that is source:name
@@ -433,8 +731,16 @@ func renameBucketsToKnownNames(buckets BucketMap, prefix string) (res BucketMap)
 	// create a bucket map that uses the known names for known sources
 	res = BucketMap{}
 	for source, applist := range buckets {
+		// a source pinned to a git ref keeps its @ref
+		url, ref := source, ""
+		if i := strings.LastIndex(source, "@"); i > 0 {
+			url, ref = source[:i], source[i:]
+		}
+
 		if name, ok := bucketsBySource[source]; ok {
 			res[prefix+name] = applist
+		} else if name, ok := bucketsBySource[url]; ok {
+			res[prefix+name+ref] = applist
 		} else {
 			// if source was a local bucket in $SCOOP/buckets, then trim the directory
 			trimmed := strings.TrimPrefix(source, bucketsPath)
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// --jobs: the number of manifests read and parsed in parallel
+var g_Jobs = runtime.NumCPU()
+
+var g_WorkerPool *WorkerPool
+var g_WorkerPoolOnce sync.Once
+
+// WorkerPool runs tasks on a fixed number of goroutines
+type WorkerPool struct {
+	tasks chan func()
+}
+
+func NewWorkerPool(size int) *WorkerPool {
+	pool := &WorkerPool{tasks: make(chan func())}
+	for i := 0; i < MaxInt(1, size); i++ {
+		go func() {
+			for task := range pool.tasks {
+				task()
+			}
+		}()
+	}
+	return pool
+}
+
+// the shared pool of g_Jobs workers, started on first use
+func workerPool() *WorkerPool {
+	g_WorkerPoolOnce.Do(func() {
+		g_WorkerPool = NewWorkerPool(g_Jobs)
+	})
+	return g_WorkerPool
+}
+
+// runs task on the pool, blocking until a worker is free, and calls wg.Done() when it finishes.
+// A task must not wait for other tasks of the same pool, or it can deadlock.
+func (pool *WorkerPool) Go(wg *sync.WaitGroup, task func()) {
+	wg.Add(1)
+	pool.tasks <- func() {
+		defer wg.Done()
+		task()
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	net_url "net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+//=========================================================
+// PROXY: scoop's proxy config, or else $env:HTTPS_PROXY, $env:HTTP_PROXY and $env:NO_PROXY
+//=========================================================
+
+// returns the proxy for a url, or nil to connect directly
+type ProxyFunc = func(url *net_url.URL) (*net_url.URL, error)
+
+var g_ProxyFunc ProxyFunc
+var g_ProxyOnce sync.Once
+
+// scoop's proxy config is currentuser@..., whose credentials git sends with windows integrated auth
+var g_ProxyCurrentUser bool
+
+// parses scoop's proxy config once
+func loadProxyConfig() {
+	g_ProxyOnce.Do(func() {
+		g_ProxyFunc = newProxyFunc(g_Config.ScoopProxy)
+	})
+}
+
+// the proxy to use for url, or nil to connect directly
+func proxyForUrl(url *net_url.URL) (*net_url.URL, error) {
+	loadProxyConfig()
+	return g_ProxyFunc(url)
+}
+
+func directProxyFunc(url *net_url.URL) (*net_url.URL, error) {
+	return nil, nil
+}
+
+func envProxyFunc() ProxyFunc {
+	return httpproxy.FromEnvironment().ProxyFunc()
+}
+
+// parses scoop's `proxy` config like scoop does:
+//
+//	[username:password@]host:port -- the password may contain `:` and `@`, and both may be %-escaped
+//	currentuser@host:port         -- the logged in user's credentials (only git can send them: downloads send none)
+//	default                       -- the system's proxy (Internet Options on windows)
+//	none                          -- connect directly
+//
+// Without a proxy config, the proxy environment variables are used.  $env:NO_PROXY applies to a configured proxy too.
+// See https://github.com/ScoopInstaller/Scoop/wiki/Using-Scoop-behind-a-proxy
+func newProxyFunc(scoopProxy string) ProxyFunc {
+	if scoopProxy == "" {
+		return envProxyFunc()
+	}
+
+	credentials, address := "", scoopProxy
+	if i := strings.LastIndex(scoopProxy, "@"); i >= 0 {
+		credentials, address = scoopProxy[:i], scoopProxy[i+1:]
+	}
+
+	var proxyFunc ProxyFunc
+	switch strings.ToLower(address) {
+	case "none":
+		return directProxyFunc
+	case "default":
+		proxyFunc = systemProxyFunc()
+	default:
+		proxyUrl := address
+		if !strings.Contains(proxyUrl, "://") {
+			proxyUrl = "http://" + proxyUrl
+		}
+		if _, err := net_url.Parse(proxyUrl); err != nil {
+			fmt.Printf(colorize("error", "*** Ignoring the proxy config: %s\n"), err)
+			return envProxyFunc()
+		}
+		proxyFunc = (&httpproxy.Config{
+			HTTPProxy:  proxyUrl,
+			HTTPSProxy: proxyUrl,
+			NoProxy:    getenvAny("NO_PROXY", "no_proxy"),
+		}).ProxyFunc()
+	}
+
+	user := proxyUserinfo(credentials)
+	if user == nil {
+		return proxyFunc
+	}
+	return func(url *net_url.URL) (*net_url.URL, error) {
+		proxy, err := proxyFunc(url)
+		if proxy != nil {
+			withUser := *proxy
+			withUser.User = user
+			proxy = &withUser
+		}
+		return proxy, err
+	}
+}
+
+// the username:password of scoop's proxy config, or nil for none or currentuser
+func proxyUserinfo(credentials string) *net_url.Userinfo {
+	if credentials == "" {
+		return nil
+	}
+	if strings.EqualFold(credentials, "currentuser") {
+		g_ProxyCurrentUser = true
+		fmt.Println(colorize("error", "*** WARNING: the proxy's currentuser credentials (windows integrated auth) are only sent by git.  Downloads send none, so a proxy that requires them fails with 407"))
+		return nil
+	}
+
+	username, password, hasPassword := strings.Cut(credentials, ":")
+	username = unescapeCredential(username)
+	if !hasPassword {
+		return net_url.User(username)
+	}
+	return net_url.UserPassword(username, unescapeCredential(password))
+}
+
+// credentials may be %-escaped, but a lone % is kept as is
+func unescapeCredential(value string) string {
+	if unescaped, err := net_url.PathUnescape(value); err == nil {
+		return unescaped
+	}
+	return value
+}
+
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// the proxy settings of Internet Options:
+//
+//	server:   host:port for all schemes, or per scheme like "http=host:port;https=host:port;socks=host:port"
+//	override: hosts that bypass the proxy like "*.example.com;10.*;<local>", where <local> is any host without a dot
+func internetOptionsProxyFunc(server string, override string) ProxyFunc {
+	proxies := map[string]string{}
+	for _, entry := range strings.Split(server, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		scheme, address, found := strings.Cut(entry, "=")
+		if !found {
+			proxies["http"], proxies["https"] = entry, entry
+			continue
+		}
+		if strings.EqualFold(scheme, "socks") {
+			address = "socks5://" + address
+		}
+		proxies[strings.ToLower(scheme)] = address
+	}
+
+	var bypass []string
+	for _, pattern := range strings.Split(override, ";") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			bypass = append(bypass, pattern)
+		}
+	}
+
+	return func(url *net_url.URL) (*net_url.URL, error) {
+		host := strings.ToLower(url.Hostname())
+		for _, pattern := range bypass {
+			if pattern == "<local>" && !strings.Contains(host, ".") {
+				return nil, nil
+			}
+			if matched, _ := path.Match(pattern, host); matched {
+				return nil, nil
+			}
+			if matched, _ := path.Match(pattern, strings.ToLower(url.Host)); matched {
+				return nil, nil
+			}
+		}
+
+		address, ok := proxies[url.Scheme]
+		if !ok {
+			address, ok = proxies["socks"]
+		}
+		if !ok {
+			return nil, nil
+		}
+		if !strings.Contains(address, "://") {
+			address = "http://" + address
+		}
+		return net_url.Parse(address)
+	}
+}
+
+//=========================================================
+// the proxy for git, which doesn't read scoop's config
+//=========================================================
+
+// the GIT_CONFIG_* pairs and environment that make git use our proxy for url
+func gitProxyConfig(url string) (config []string, env []string) {
+	parsed, err := net_url.Parse(url)
+	if err != nil || parsed.Scheme == "" || parsed.Scheme == "file" {
+		return
+	}
+	proxy, err := proxyForUrl(parsed)
+	if err != nil || proxy == nil {
+		// git would otherwise use its own http.proxy config or the environment
+		return []string{"http.proxy", ""}, []string{"no_proxy=*", "NO_PROXY=*"}
+	}
+	if g_ProxyCurrentUser && proxy.User == nil {
+		// empty credentials make git (libcurl) authenticate as the logged in user with NTLM or Kerberos
+		withUser := *proxy
+		withUser.User = net_url.UserPassword("", "")
+		return []string{"http.proxy", withUser.String(), "http.proxyAuthMethod", "anyauth"}, nil
+	}
+	return []string{"http.proxy", proxy.String()}, nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// without Internet Options, the system's proxy is the environment's
+func systemProxyFunc() ProxyFunc {
+	return envProxyFunc()
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"golang.org/x/sys/windows/registry"
+)
+
+// the proxy of Internet Options, the same one scoop's "default" proxy uses
+func systemProxyFunc() ProxyFunc {
+	key, err := registry.OpenKey(registry.CURRENT_USER, `Software\Microsoft\Windows\CurrentVersion\Internet Settings`, registry.QUERY_VALUE)
+	if err != nil {
+		return envProxyFunc()
+	}
+	defer key.Close()
+
+	enabled, _, err := key.GetIntegerValue("ProxyEnable")
+	if err != nil || enabled == 0 {
+		return directProxyFunc
+	}
+	server, _, _ := key.GetStringValue("ProxyServer")
+	override, _, _ := key.GetStringValue("ProxyOverride")
+	return internetOptionsProxyFunc(server, override)
+}
@@ -1,98 +1,317 @@
 package main
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	net_url "net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/klauspost/compress/zstd"
 	"github.com/valyala/fastjson"
 )
 
-// routes to the appropriate bucket source loader based on `kind` or url/file format
-func loadBucketsFrom(kind string, path string) (buckets BucketMap, err error) {
-	switch kind {
-	case "buckets":
-		switch {
-		case strings.HasSuffix(path, ".json"):
-			buckets, err = loadBucketsFromNameSourceJson(path)
-		default: // assume it is a local path
-			buckets = loadBucketsFromDir(path)
-		}
-	case "html":
-		buckets, err = loadBucketsFromHtml(path)
-	default:
-		var appList AppList
-		if strings.Contains(path, "://") {
-			switch {
-			case strings.HasSuffix(path, ".html") || strings.HasSuffix(path, ".htm"):
-				buckets, err = loadBucketsFromHtml(path)
-			case strings.HasSuffix(path, ".zip") || strings.Contains(path, "/zipball/"):
-				appList = loadAppListFromZipUrl(path)
-			default:
-				appList = loadAppListFromGitRepoUrl(path)
+// catch-all loaders are registered as fallbacks, so the loaders of other files are consulted first
+func init() {
+	registerSourceLoader(&sourceLoader{
+		kind:        "buckets",
+		description: "a local folder of buckets, or a local or remote buckets.json of name:source pairs (which may be other buckets.json)",
+		match:       func(src *SourceRef) bool { return src.Kind == "buckets" },
+		load: func(src *SourceRef, out io.Writer) (BucketMap, error) {
+			if strings.HasSuffix(src.Path, ".json") {
+				return loadBucketsFromNameSourceJson(out, src.Path)
 			}
-		} else { // it's a local file
-			// normalize path separator
-			path = strings.ReplaceAll(path, "/", "\\")
-			switch {
-			case strings.HasSuffix(path, ".html") || strings.HasSuffix(path, ".htm"):
-				readCloser, err := os.Open(path)
-				check(err)
-				buckets, err = loadBucketsFromHtmlReader(readCloser)
-				check(err)
-			case strings.HasSuffix(path, ".zip"):
-				appList = loadAppListFromZip(path)
-			default:
-				appList = loadAppListFromDir(path)
+			return loadBucketsFromDir(out, src.Path)
+		},
+	})
+	registerSourceLoader(&sourceLoader{
+		kind:        "html",
+		description: "an html page with tables of apps, like rasa's scoop-directory (*.html, *.htm)",
+		match: func(src *SourceRef) bool {
+			return src.Kind == "html" || src.isAutoKind() && hasAnySuffix(src.Path, ".html", ".htm")
+		},
+		load: func(src *SourceRef, out io.Writer) (BucketMap, error) {
+			return loadBucketsFromHtml(out, localOrUrlPath(src.Path))
+		},
+	})
+	registerSourceLoader(&sourceLoader{
+		kind:        "markdown",
+		description: "a markdown page with tables of apps, like rasa's scoop-directory (*.md, *.markdown)",
+		match: func(src *SourceRef) bool {
+			return src.Kind == "markdown" || src.isAutoKind() && hasAnySuffix(src.Path, ".md", ".markdown")
+		},
+		load: func(src *SourceRef, out io.Writer) (BucketMap, error) {
+			return loadBucketsFromMarkdown(out, localOrUrlPath(src.Path))
+		},
+	})
+	registerSourceLoader(&sourceLoader{
+		kind:        "zip",
+		description: "a local or remote zip of a bucket (*.zip, github /zipball/)",
+		match: func(src *SourceRef) bool {
+			return src.Kind == "zip" || src.isAutoKind() && (strings.HasSuffix(src.Path, ".zip") || isUrl(src.Path) && strings.Contains(src.Path, "/zipball/"))
+		},
+		load: func(src *SourceRef, out io.Writer) (BucketMap, error) {
+			path := localOrUrlPath(src.Path)
+			if isUrl(path) {
+				appList, err := loadAppListFromZipUrl(out, path)
+				return BucketMap{path: appList}, err
 			}
-		}
-		if buckets == nil {
-			buckets = BucketMap{path: appList}
-		}
+			appList, err := loadAppListFromZip(out, path)
+			return BucketMap{path: appList}, err
+		},
+	})
+	registerSourceLoader(&sourceLoader{
+		kind:        "tar",
+		description: "a local or remote tarball of a bucket (*.tar, *.tar.gz, *.tgz, *.tar.zst, github /tarball/)",
+		match: func(src *SourceRef) bool {
+			return src.Kind == "tar" || src.isAutoKind() && (hasAnySuffix(src.Path, g_TarSuffixes...) || isUrl(src.Path) && strings.Contains(src.Path, "/tarball/"))
+		},
+		load: func(src *SourceRef, out io.Writer) (buckets BucketMap, err error) {
+			var appList AppList
+			path := localOrUrlPath(src.Path)
+			if isUrl(path) {
+				appList, err = loadAppListFromTarUrl(out, path)
+			} else {
+				appList, err = loadAppListFromTar(out, path)
+			}
+			return BucketMap{path: appList}, err
+		},
+	})
+	registerSourceLoader(&sourceLoader{
+		kind:        "manifests-json",
+		description: "a local or remote json of manifests from many buckets, like mertd/shovel-data",
+		match:       func(src *SourceRef) bool { return src.Kind == "manifests-json" },
+		load: func(src *SourceRef, out io.Writer) (BucketMap, error) {
+			return loadBucketsFromManifestsJson(out, localOrUrlPath(src.Path))
+		},
+	})
+	registerFallbackSourceLoader(&sourceLoader{
+		kind:        "git",
+		description: "a git repo of a bucket: a remote url cloned into the cache (any other url, or user@host:path), or a local bare repo or packfile (*.git, *.pack)",
+		match: func(src *SourceRef) bool {
+			return src.Kind == "git" || src.isAutoKind() && (isGitRemote(src.Path) || hasAnySuffix(src.Path, ".git", ".pack"))
+		},
+		load: func(src *SourceRef, out io.Writer) (buckets BucketMap, err error) {
+			var appList AppList
+			path := localOrUrlPath(src.Path)
+			if isGitRemote(path) {
+				appList, err = loadAppListFromGitRepoUrl(out, path, src.Ref)
+			} else {
+				appList, err = loadAppListFromGitObjects(out, path, src.Ref)
+			}
+			if src.Ref != "" {
+				path += "@" + src.Ref
+			}
+			return BucketMap{path: appList}, err
+		},
+	})
+	registerFallbackSourceLoader(&sourceLoader{
+		kind:        "bucket",
+		description: "a local bucket folder (any other path)",
+		match:       func(src *SourceRef) bool { return src.isAutoKind() && !isGitRemote(src.Path) },
+		load: func(src *SourceRef, out io.Writer) (BucketMap, error) {
+			path := localOrUrlPath(src.Path)
+			appList, err := loadAppListFromDir(out, path)
+			return BucketMap{path: appList}, err
+		},
+	})
+}
+
+// routes to the registered SourceLoader that matches the source's `kind` or url/file format
+func loadBucketsFrom(src *SourceRef, out io.Writer) (buckets BucketMap, err error) {
+	loader := findSourceLoader(src)
+	if loader == nil {
+		return nil, fmt.Errorf("no loader for source kind [%s]: %s", src.Kind, src.Path)
 	}
-	return
+	return loader.Load(src, out)
+}
+
+func isUrl(path string) bool {
+	return strings.Contains(path, "://")
+}
+
+// git's scp-like syntax for ssh: user@host:path
+var g_GitScpUrlRE = regexp.MustCompile(`^[\w.-]+@[\w.-]+:[^\s]+$`)
+
+// a url, or an scp-like user@host:path that only git can fetch
+func isGitRemote(path string) bool {
+	return isUrl(path) || g_GitScpUrlRE.MatchString(path)
+}
+
+// normalizes the path separator of local files.  urls (and scp-like git urls) are returned as is.
+func localOrUrlPath(path string) string {
+	if isGitRemote(path) {
+		return path
+	}
+	return strings.ReplaceAll(path, "/", "\\")
 }
 
 // searches for term in given json manifest
 // this does NOT set app.name, since that is not in the json
 // https://github.com/ScoopInstaller/scoop/wiki/App-Manifests
-func loadAppFromManifest(manifestPath string, json []byte) (app *AppInfo) {
+func loadAppFromManifest(out io.Writer, manifestPath string, json []byte) (app *AppInfo) {
+	var parser fastjson.Parser
+	result, _ := parser.ParseBytes(json)
+
+	return loadAppFromManifestValue(out, manifestPath, result)
+}
+
+// extracts the app info from an already parsed manifest
+func loadAppFromManifestValue(out io.Writer, manifestPath string, result *fastjson.Value) (app *AppInfo) {
 	finalMsg := ""
 	defer func() { // catch if fastjson panics
 		// recover from panic if one occured. Set err to nil otherwise.
 		if recover() != nil {
 			app = nil
-			fmt.Printf(colorize("error", "*** Skipped BROKEN manifest: %s\n"), manifestPath)
+			fmt.Fprintf(out, colorize("error", "*** Skipped BROKEN manifest: %s\n"), manifestPath)
 		} else if finalMsg != "" {
-			fmt.Printf(colorize("error", "*** Including BROKEN manifest (%s): %s\n"), finalMsg, manifestPath)
+			fmt.Fprintf(out, colorize("error", "*** Including BROKEN manifest (%s): %s\n"), finalMsg, manifestPath)
 		}
 	}()
 
 	app = &AppInfo{}
 
-	var parser fastjson.Parser
-	result, _ := parser.ParseBytes(json)
-
 	version := string(result.GetStringBytes("version"))
 	description := string(result.GetStringBytes("description"))
 	homepage := string(result.GetStringBytes("homepage"))
 
-	var bins []string
-	bin := result.Get("bin") // can be: nil, string, [](string | []string)
+	bins, ok := binsFromValue(result.Get("bin"))
+	if !ok {
+		finalMsg = `bad "bin"`
+	}
+
+	app.Version = version
+	app.Description = description
+	app.Homepage = homepage
+	app.Bins = bins
+	//app.loaded = true
+
+	app.License, app.LicenseUrl = licenseFromValue(result.Get("license"))
+	app.Notes = strings.Join(stringsFromValue(result.Get("notes")), "\n")
+	app.Depends = stringsFromValue(result.Get("depends"))
+	app.Suggest = suggestFromValue(result.Get("suggest"))
+	app.Shortcuts = shortcutsFromValue(result.Get("shortcuts"))
+	app.EnvAddPath = stringsFromValue(result.Get("env_add_path"))
+	app.Persist = persistFromValue(result.Get("persist"))
+	app.Urls = stringsFromValue(result.Get("url"))
+	app.Hashes = stringsFromValue(result.Get("hash"))
+	app.HasCheckver = result.Exists("checkver")
+	app.HasAutoupdate = result.Exists("autoupdate")
+
+	if architecture := result.GetObject("architecture"); architecture != nil {
+		app.Architectures = map[string]*AppArchitecture{}
+		architecture.Visit(func(key []byte, value *fastjson.Value) {
+			arch := &AppArchitecture{
+				Urls:   stringsFromValue(value.Get("url")),
+				Hashes: stringsFromValue(value.Get("hash")),
+			}
+			if arch.Bins, ok = binsFromValue(value.Get("bin")); !ok {
+				finalMsg = `bad "bin" of architecture ` + string(key)
+			}
+			app.Architectures[string(key)] = arch
+		})
+	}
+
+	return app
+}
+
+// a string, or an array of strings.  Anything else in the array is skipped
+func stringsFromValue(value *fastjson.Value) (list []string) {
+	if value == nil {
+		return
+	}
+	if value.Type() == fastjson.TypeString {
+		return []string{string(value.GetStringBytes())}
+	}
+	for _, item := range value.GetArray() {
+		if item.Type() == fastjson.TypeString {
+			list = append(list, string(item.GetStringBytes()))
+		}
+	}
+	return
+}
+
+// "license": "MIT" or { "identifier": "Freeware", "url": "https://..." }
+func licenseFromValue(value *fastjson.Value) (license string, url string) {
+	if value == nil {
+		return
+	}
+	if value.Type() == fastjson.TypeString {
+		return string(value.GetStringBytes()), ""
+	}
+	license = string(value.GetStringBytes("identifier"))
+	url = string(value.GetStringBytes("url"))
+	if license == "" {
+		license = url
+	}
+	return
+}
+
+// "suggest": { "JDK": [ "java/oraclejdk", "java/openjdk" ], "vcredist": "extras/vcredist2022" }
+func suggestFromValue(value *fastjson.Value) (suggest map[string][]string) {
+	object := value.GetObject()
+	if object == nil {
+		return
+	}
+	suggest = map[string][]string{}
+	object.Visit(func(feature []byte, apps *fastjson.Value) {
+		suggest[string(feature)] = stringsFromValue(apps)
+	})
+	return
+}
+
+// "shortcuts": [ [ "program.exe", "Program Name", "--args", "icon.ico" ], ... ]
+func shortcutsFromValue(value *fastjson.Value) (shortcuts []AppShortcut) {
+	for _, item := range value.GetArray() {
+		fields := stringsFromValue(item)
+		if len(fields) >= 2 {
+			shortcuts = append(shortcuts, AppShortcut{Target: fields[0], Name: fields[1]})
+		}
+	}
+	return
+}
+
+// "persist": "data" or [ "data", [ "config.ini", "config.ini.default" ] ], where only the persisted path is kept
+func persistFromValue(value *fastjson.Value) (persist []string) {
+	if value == nil {
+		return
+	}
+	if value.Type() == fastjson.TypeString {
+		return stringsFromValue(value)
+	}
+	for _, item := range value.GetArray() {
+		if fields := stringsFromValue(item); len(fields) > 0 {
+			persist = append(persist, fields[0])
+		}
+	}
+	return
+}
+
+// extracts the bin paths and aliases of a manifest's "bin", which can be: nil, string, [](string | []string)
+// ok is false when it has an unexpected type, but the bins found are still returned
+func binsFromValue(bin *fastjson.Value) (bins []string, ok bool) {
+	ok = true
 	if bin != nil {
-		errMsg := `bad "bin"`
 		switch bin.Type() {
 		case fastjson.TypeString:
 			// "bin": "myprog.exe",
@@ -118,35 +337,82 @@ func loadAppFromManifest(manifestPath string, json []byte) (app *AppInfo) {
 						}
 					}
 				default:
-					finalMsg = errMsg
+					ok = false
 					//log.Fatalln(badManifestErrMsg)
 				}
 			}
 		default:
-			finalMsg = errMsg
+			ok = false
 			//log.Fatalln(badManifestErrMsg)
 		}
 	}
+	return
+}
 
-	app.Version = version
-	app.Description = description
-	app.Homepage = homepage
-	app.Bins = bins
-	//app.loaded = true
+// a manifest to read and parse on the worker pool
+type manifestJob struct {
+	filePath string // shown in errors
+	name     string // the app name
+	read     func() ([]byte, error)
+}
 
-	return app
+// reads and parses the manifests on the worker pool.  The returned apps are in no particular order.
+func loadAppsFromManifests(out io.Writer, jobs []manifestJob) (apps AppList, err error) {
+	results := make([]*AppInfo, len(jobs))
+	errs := make([]error, len(jobs))
+
+	var wg sync.WaitGroup
+	pool := workerPool()
+	for i := range jobs {
+		i := i
+		pool.Go(&wg, func() {
+			body, err := jobs[i].read()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			// parse relevant data from manifest
+			app := loadAppFromManifest(out, jobs[i].filePath, body)
+			if app != nil {
+				app.Name = jobs[i].name
+				results[i] = app
+			}
+		})
+	}
+	wg.Wait()
+
+	for i, app := range results {
+		if errs[i] != nil && err == nil {
+			err = errs[i]
+		}
+		if app != nil {
+			apps = append(apps, app)
+		}
+	}
+	return
+}
+
+// loads a local bucket from its index, or else parses its manifests
+func loadAppListFromDir(out io.Writer, path string) (apps AppList, err error) {
+	return indexedAppList(out, path, dirRevision(path), func() (AppList, error) {
+		return parseAppListFromDir(out, path)
+	})
 }
 
 // currently only searches given path for ./bucket/*.json or else ./*.json
-func loadAppListFromDir(path string) (apps AppList) {
+func parseAppListFromDir(out io.Writer, path string) (apps AppList, err error) {
 	subBucketPath := filepath.Join(path, "bucket")
-	if f, err := os.Stat(subBucketPath); !os.IsNotExist(err) && f.IsDir() {
+	if f, err := os.Stat(subBucketPath); err == nil && f.IsDir() {
 		path = subBucketPath
 	}
 
 	fileInfos, err := os.ReadDir(path)
-	check(err)
+	if err != nil {
+		return
+	}
 
+	var jobs []manifestJob
 	for _, fileInfo := range fileInfos {
 		name := fileInfo.Name()
 
@@ -156,44 +422,93 @@ func loadAppListFromDir(path string) (apps AppList) {
 		}
 
 		filePath := filepath.Join(path, name)
-		body, err := os.ReadFile(filePath)
-		check(err)
-
-		// parse relevant data from manifest
-		app := loadAppFromManifest(filePath, body)
-		if app != nil {
-			app.Name = name[:len(name)-5]
-			apps = append(apps, app)
-		}
+		jobs = append(jobs, manifestJob{
+			filePath: filePath,
+			name:     name[:len(name)-5],
+			read:     func() ([]byte, error) { return os.ReadFile(filePath) },
+		})
 	}
 
-	return apps
+	return loadAppsFromManifests(out, jobs)
+}
+
+// the error of a source whose buckets or entries partly failed.  Each failure is already printed on its own status line,
+// so only their count is reported, but errors.Is still finds the errors of each
+type PartialError struct {
+	Failed int
+	Total  int
+	What   string // "buckets" or "entries"
+	Errs   []error
+}
+
+func (err *PartialError) Error() string {
+	return fmt.Sprintf("%d of %d %s failed", err.Failed, err.Total, err.What)
+}
+
+func (err *PartialError) Unwrap() []error {
+	return err.Errs
 }
 
-func loadBucketsFromDir(bucketsPath string) (buckets BucketMap) {
+// nil if nothing failed
+func partialError(errs []error, total int, what string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &PartialError{Failed: len(errs), Total: total, What: what, Errs: errs}
+}
+
+// loads each bucket folder in bucketsPath.  The buckets that fail are left out, and each is listed with its error
+func loadBucketsFromDir(out io.Writer, bucketsPath string) (buckets BucketMap, err error) {
 	bucketDirEntries, err := os.ReadDir(bucketsPath)
-	checkWith(err, "Buckets folder does not exist")
+	if err != nil {
+		return nil, fmt.Errorf("buckets folder does not exist: %w", err)
+	}
+	failures := map[string]error{}
 
 	var mutex sync.Mutex
 	var wg sync.WaitGroup
 
+	// at most g_Jobs buckets are listed at once.  Their manifests are parsed by the worker pool
+	limit := make(chan struct{}, MaxInt(1, g_Jobs))
+
 	buckets = BucketMap{}
 	for _, bucketDirEntry := range bucketDirEntries {
+		if !bucketDirEntry.IsDir() {
+			continue
+		}
 		wg.Add(1)
 		go func(file os.DirEntry) {
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
 			bucketName := file.Name()
 			bucketPath := filepath.Join(bucketsPath, bucketName)
-			appList := loadAppListFromDir(bucketPath)
+			appList, err := loadAppListFromDir(out, bucketPath)
 
 			mutex.Lock()
-			buckets[bucketPath] = appList
+			if err != nil {
+				failures[bucketName] = err
+			} else {
+				buckets[bucketPath] = appList
+			}
 			mutex.Unlock()
 
 			wg.Done()
 		}(bucketDirEntry)
 	}
 	wg.Wait()
-	return
+
+	names := make([]string, 0, len(failures))
+	for name := range failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		fmt.Fprintf(out, colorize("error", "  - %s: %s\n"), name, failures[name])
+		errs = append(errs, failures[name])
+	}
+	return buckets, partialError(errs, len(buckets)+len(errs), "buckets")
 }
 
 func loadInstalledApps(appsPath string, apps *NameSourceMap) (err error) {
@@ -215,73 +530,253 @@ func loadInstalledApps(appsPath string, apps *NameSourceMap) (err error) {
 // ZIP: Load a Bucket's App List from a local .zip
 //=========================================================
 
-func loadAppListFromZip(path string) (appList AppList) {
+// appxxx.json can either be in the root or in a /bucket/ subdirectory at any depth of an archive
+var g_AppManifestPathRE = regexp.MustCompile(`(^|(?:^|/|\\)bucket(?:/|\\))([^/\\]*)\.json$`)
+
+// loads a zip's bucket from its index, or else parses its manifests
+func loadAppListFromZip(out io.Writer, path string) (appList AppList, err error) {
+	return indexedAppList(out, path, cacheRevision(path), func() (AppList, error) {
+		return parseAppListFromZip(out, path)
+	})
+}
+
+func parseAppListFromZip(out io.Writer, path string) (appList AppList, err error) {
 	zipReader, err := zip.OpenReader(path)
-	check(err)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
 	defer zipReader.Close()
 
-	// appxxx.json can either be in the root or in a /bucket/ subdirectory at any depth
-	re_appManifestPath := regexp.MustCompile(`(^|(?:^|/|\\)bucket(?:/|\\))([^/\\]*)\.json$`)
-
+	var jobs []manifestJob
 	for _, file := range zipReader.Reader.File {
 		innerPath := file.Name // path within zip file
-		//fmt.Printf("innerPath = %#v\n", innerPath)
+		//fmt.Fprintf(out, "innerPath = %#v\n", innerPath)
 
 		// only search *.json in bucket/ or root
-		if re_appManifestPath.MatchString(innerPath) {
-			// uncompress file body
-			readCloser, err := file.Open()
-			check(err)
-			body, err := io.ReadAll(readCloser)
-			readCloser.Close()
-			check(err)
-
-			filePath := fmt.Sprintf("%s:%s", path, innerPath)
-			app := loadAppFromManifest(filePath, body)
-			if app != nil {
-				_, filename := filepath.Split(innerPath)
-				app.Name = filename[:len(filename)-5] // remove ".json"
-				appList = append(appList, app)
-			}
+		if g_AppManifestPathRE.MatchString(innerPath) {
+			_, filename := filepath.Split(innerPath)
+			file := file
+			jobs = append(jobs, manifestJob{
+				filePath: fmt.Sprintf("%s:%s", path, innerPath),
+				name:     filename[:len(filename)-5], // remove ".json"
+				read: func() ([]byte, error) {
+					// uncompress file body
+					readCloser, err := file.Open()
+					if err != nil {
+						return nil, err
+					}
+					defer readCloser.Close()
+					return io.ReadAll(readCloser)
+				},
+			})
 		}
 	}
-	return
+
+	return loadAppsFromManifests(out, jobs)
 }
 
 // downloads a bucket as a zip and searches its manifests
-func loadAppListFromZipUrl(url string) (appList AppList) {
+func loadAppListFromZipUrl(out io.Writer, url string) (appList AppList, err error) {
 	cachePath := filepath.Join(scoopCache("buckets"), net_url.QueryEscape(url)+".zip")
-	cacheGetUrl(cachePath, url)
-	appList = loadAppListFromZip(cachePath)
-	return appList
+	if err = cacheGetUrlOrStale(out, cachePath, url); err != nil {
+		return
+	}
+	return loadAppListFromZip(out, cachePath)
 }
 
 //=========================================================
-// HTML: Load buckets from Html (primarily rasa's directory)
+// TAR: Load a Bucket's App List from a local .tar, .tar.gz, .tgz or .tar.zst
+//=========================================================
+
+var g_TarSuffixes = []string{".tar", ".tar.gz", ".tgz", ".tar.zst", ".tar.zstd"}
+
+// loads a tarball's bucket from its index, or else parses its manifests
+func loadAppListFromTar(out io.Writer, path string) (appList AppList, err error) {
+	return indexedAppList(out, path, cacheRevision(path), func() (AppList, error) {
+		return parseAppListFromTar(out, path)
+	})
+}
+
+func parseAppListFromTar(out io.Writer, path string) (appList AppList, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	// the compression is detected from the content, since cached urls don't keep their suffix
+	body, err := decompressTar(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer body.Close()
+
+	var jobs []manifestJob
+	tarReader := tar.NewReader(body)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return appList, fmt.Errorf("%s: %w", path, err)
+		}
+
+		innerPath := header.Name // path within tar file
+
+		// only search *.json in bucket/ or root
+		if header.Typeflag != tar.TypeReg || !g_AppManifestPathRE.MatchString(innerPath) {
+			continue
+		}
+
+		// a tar can only be read in order, so just the parsing is done on the worker pool
+		body, err := io.ReadAll(tarReader)
+		if err != nil {
+			return appList, fmt.Errorf("%s:%s: %w", path, innerPath, err)
+		}
+
+		_, filename := filepath.Split(innerPath)
+		jobs = append(jobs, manifestJob{
+			filePath: fmt.Sprintf("%s:%s", path, innerPath),
+			name:     filename[:len(filename)-5], // remove ".json"
+			read:     func() ([]byte, error) { return body, nil },
+		})
+	}
+	return loadAppsFromManifests(out, jobs)
+}
+
+// wraps the tar stream in a gzip or zstd decompressor based upon its magic bytes
+func decompressTar(file io.Reader) (body io.ReadCloser, err error) {
+	buffered := bufio.NewReader(file)
+	magic, _ := buffered.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default: // uncompressed .tar
+		return io.NopCloser(buffered), nil
+	}
+}
+
+// downloads a bucket as a tarball and searches its manifests
+func loadAppListFromTarUrl(out io.Writer, url string) (appList AppList, err error) {
+	cachePath := filepath.Join(scoopCache("buckets"), net_url.QueryEscape(url)+".tar")
+	if err = cacheGetUrlOrStale(out, cachePath, url); err != nil {
+		return
+	}
+	return loadAppListFromTar(out, cachePath)
+}
+
 //=========================================================
+// Manifests JSON: Load buckets from a json of aggregated manifests (mertd/shovel-data)
+//=========================================================
+
+// The manifests can be grouped in any of these shapes:
+//
+//	[ {"name": "app", "bucket": "main", ...manifest}, ... ]
+//	{ "main": { "app": {...manifest}, ... }, ... }
+//	{ "main": [ {"name": "app", ...manifest}, ... ], ... }
+func loadBucketsFromManifestsJson(out io.Writer, url string) (buckets BucketMap, err error) {
+	filePath := url
+	if isUrl(url) {
+		filePath = filepath.Join(scoopCache("buckets"), net_url.QueryEscape(url)+".json")
+		if err = cacheGetUrlOrStale(out, filePath, url); err != nil {
+			return
+		}
+	} // else the url is already a filepath
+
+	return indexedBuckets(out, filePath, cacheRevision(filePath), func() (BucketMap, error) {
+		return parseBucketsFromManifestsJson(out, filePath)
+	})
+}
+
+func parseBucketsFromManifestsJson(out io.Writer, filePath string) (buckets BucketMap, err error) {
+	body, err := os.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+
+	var parser fastjson.Parser
+	root, err := parser.ParseBytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	buckets = BucketMap{}
+
+	// appends the manifest to its bucket, using the name/bucket fields when missing
+	addManifest := func(bucket string, name string, manifest *fastjson.Value) {
+		if name == "" {
+			name = string(manifest.GetStringBytes("name"))
+		}
+		if bucket == "" {
+			bucket = string(manifest.GetStringBytes("bucket"))
+		}
+		if name == "" {
+			return
+		}
+
+		app := loadAppFromManifestValue(out, fmt.Sprintf("%s:%s/%s", filePath, bucket, name), manifest)
+		if app != nil {
+			app.Name = name
+			buckets[bucket] = append(buckets[bucket], app)
+		}
+	}
+
+	switch root.Type() {
+	case fastjson.TypeArray:
+		for _, manifest := range root.GetArray() {
+			addManifest("", "", manifest)
+		}
+	case fastjson.TypeObject:
+		root.GetObject().Visit(func(bucket []byte, apps *fastjson.Value) {
+			switch apps.Type() {
+			case fastjson.TypeObject:
+				apps.GetObject().Visit(func(name []byte, manifest *fastjson.Value) {
+					addManifest(string(bucket), string(name), manifest)
+				})
+			case fastjson.TypeArray:
+				for _, manifest := range apps.GetArray() {
+					addManifest(string(bucket), "", manifest)
+				}
+			}
+		})
+	default:
+		return nil, fmt.Errorf("%s: expected a json array or object of manifests", filePath)
+	}
+
+	return
+}
 
-func loadBucketsFromHtml(url string) (buckets BucketMap, err error) {
-	var bodyReader io.ReadCloser
+//=========================================================
+// HTML: Load buckets from Html (primarily rasa's directory)
+//=========================================================
 
+func loadBucketsFromHtml(out io.Writer, url string) (buckets BucketMap, err error) {
 	filePath := url
-	if strings.Contains(url, "://") {
+	if isUrl(url) {
 		// add .html just in case the url doesn't include it
 		filePath = filepath.Join(scoopCache("buckets"), net_url.QueryEscape(url)+".html")
-		err = cacheGetUrl(filePath, url)
-		if err != nil {
-			// if cache doesn't exist
-			f, err2 := os.Stat(filePath)
-			if os.IsNotExist(err2) {
-				return
-			}
-			// error downloading, but we have a stale cache we can use
-			fmt.Printf("Failed to download, so using stale cache from %s ...", f.ModTime().Format(time.RFC1123Z))
+		if err = cacheGetUrlOrStale(out, filePath, url); err != nil {
+			return
 		}
 	} // else the url is already a filepath
 
-	bodyReader, _ = os.Open(filePath)
+	return indexedBuckets(out, filePath, cacheRevision(filePath), func() (BucketMap, error) {
+		bodyReader, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer bodyReader.Close()
 
-	return loadBucketsFromHtmlReader(bodyReader)
+		return loadBucketsFromHtmlReader(bodyReader)
+	})
 }
 
 func loadBucketsFromHtmlReader(body io.ReadCloser) (buckets BucketMap, err error) {
@@ -315,18 +810,7 @@ func loadBucketsFromHtmlReader(body io.ReadCloser) (buckets BucketMap, err error
 		})
 
 		// find index of columns we are interested in
-		namei, versioni, descriptioni := -1, -1, -1
-		for icol, col := range headings {
-			label := strings.ToLower(col)
-			switch {
-			case strings.Contains(label, "name"):
-				namei = icol
-			case strings.Contains(label, "ver"):
-				versioni = icol
-			case strings.Contains(label, "desc"):
-				descriptioni = icol
-			}
-		}
+		namei, versioni, descriptioni := findAppColumns(headings)
 		// fmt.Printf("namei=%d, versioni=%d, descriptioni=%d\n", namei, versioni, descriptioni)
 		// fmt.Printf("headings = %v\n", headings)
 		// for _, row := range rows {
@@ -358,12 +842,9 @@ func loadBucketsFromHtmlReader(body io.ReadCloser) (buckets BucketMap, err error
 		apps := AppList{}
 
 		for _, row := range rows {
-			app := AppInfo{}
-			app.Name = strings.TrimSpace(row[namei])
-			app.Version = strings.TrimSpace(row[versioni])
-			app.Description = strings.TrimSpace(row[descriptioni])
+			app := appFromRow(row, namei, versioni, descriptioni)
 			//fmt.Printf("app=%#v\n", app)
-			apps = append(apps, &app)
+			apps = append(apps, app)
 
 		}
 
@@ -373,145 +854,621 @@ func loadBucketsFromHtmlReader(body io.ReadCloser) (buckets BucketMap, err error
 	return
 }
 
-//=========================================================
-// Git: Loads a Bucket by first cloning a repo url
-//=========================================================
+// finds the index of the name, version and description columns of a table from its headings (-1 if missing)
+func findAppColumns(headings []string) (namei, versioni, descriptioni int) {
+	namei, versioni, descriptioni = -1, -1, -1
+	for icol, col := range headings {
+		label := strings.ToLower(col)
+		switch {
+		case strings.Contains(label, "name"):
+			namei = icol
+		case strings.Contains(label, "ver"):
+			versioni = icol
+		case strings.Contains(label, "desc"):
+			descriptioni = icol
+		}
+	}
+	return
+}
 
-// Load a bucket by locally cloning a Git repo
-func cacheGitRepo(url string) (repoPath string) {
+// builds an app from a table row, skipping columns that are missing from the table or row
+func appFromRow(row []string, namei, versioni, descriptioni int) *AppInfo {
+	cell := func(i int) string {
+		if i < 0 || len(row) <= i {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
 
-	repoPath = filepath.Join(scoopCache("buckets"), net_url.QueryEscape(url))
+	app := AppInfo{}
+	app.Name = cell(namei)
+	app.Version = cell(versioni)
+	app.Description = cell(descriptioni)
+	return &app
+}
 
-	var stdout bytes.Buffer
-	var cmdline []string
+//=========================================================
+// Markdown: Load buckets from Markdown tables (rasa's directory as by-score.md or by-apps.md)
+//=========================================================
 
-	_, err := os.Stat(filepath.Join(repoPath, ".git"))
-	if os.IsNotExist(err) {
-		cmdline = []string{"git", "clone", url, repoPath}
-		log.Println("Cloning repository: " + url)
+func loadBucketsFromMarkdown(out io.Writer, url string) (buckets BucketMap, err error) {
+	filePath := url
+	if isUrl(url) {
+		// add .md just in case the url doesn't include it
+		filePath = filepath.Join(scoopCache("buckets"), net_url.QueryEscape(url)+".md")
+		if err = cacheGetUrlOrStale(out, filePath, url); err != nil {
+			return
+		}
+	} // else the url is already a filepath
+
+	return indexedBuckets(out, filePath, cacheRevision(filePath), func() (BucketMap, error) {
+		body, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+
+		return loadBucketsFromMarkdownReader(body)
+	})
+}
+
+var g_MarkdownLinkRE = regexp.MustCompile(`!?\[([^\]]*)\]\(([^)\s]*)[^)]*\)`)
+var g_MarkdownTableSeparatorRE = regexp.MustCompile(`^\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?$`)
+var g_HtmlTagRE = regexp.MustCompile(`<[^>]*>`)
+
+// parses each table that has a name column into a bucket.
+// Like the html loader, the bucket's source is the first github link in the nearest line before the table.
+func loadBucketsFromMarkdownReader(body io.Reader) (buckets BucketMap, err error) {
+	buckets = BucketMap{}
+
+	source := ""
+	var headings []string
+	namei, versioni, descriptioni := -1, -1, -1
+	var apps AppList
+	inTable := false
+
+	endTable := func() {
+		if inTable {
+			if namei >= 0 {
+				buckets[source] = append(buckets[source], apps...)
+			}
+			inTable, apps, source = false, nil, ""
+		}
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var prevLine string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case inTable && strings.HasPrefix(line, "|"):
+			if namei >= 0 {
+				apps = append(apps, appFromRow(markdownTableCells(line), namei, versioni, descriptioni))
+			}
+		case !inTable && g_MarkdownTableSeparatorRE.MatchString(line) && strings.Contains(prevLine, "|"):
+			// the previous line was the table's headings
+			headings = markdownTableCells(prevLine)
+			namei, versioni, descriptioni = findAppColumns(headings)
+			inTable = true
+		default:
+			endTable()
+			// get the bucket source url
+			for _, link := range g_MarkdownLinkRE.FindAllStringSubmatch(line, -1) {
+				if strings.Contains(link[2], "github.com") {
+					source = link[2]
+					break
+				}
+			}
+		}
+		prevLine = line
+	}
+	endTable()
+
+	return buckets, scanner.Err()
+}
+
+// splits a table row into its cells' text, without markdown links or html tags
+func markdownTableCells(line string) (cells []string) {
+	line = strings.TrimPrefix(strings.TrimSpace(line), "|")
+	line = strings.TrimSuffix(line, "|")
+
+	// split on | unless escaped
+	var cell strings.Builder
+	addCell := func() {
+		text := g_MarkdownLinkRE.ReplaceAllString(cell.String(), "$1")
+		text = g_HtmlTagRE.ReplaceAllString(text, " ")
+		cells = append(cells, strings.TrimSpace(text))
+		cell.Reset()
+	}
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			addCell()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	addCell()
+	return
+}
+
+//=========================================================
+// Git: Loads a Bucket by first cloning a repo url
+//=========================================================
+
+// the manifests of a bucket, which are all a sparse checkout needs
+var g_GitSparsePatterns = []string{"/bucket/", "/*.json"}
+
+// Load a bucket by locally cloning a Git repo: a shallow, sparse clone of just ref (or HEAD) and its manifests,
+// which is only fetched again once it is older than the cache duration.
+// Each ref gets its own clone, checked out at ref, unless the pure-Go client keeps a bare clone of every ref.
+func cacheGitRepo(out io.Writer, url string, ref string) (repoPath string, err error) {
+
+	repoPath = filepath.Join(scoopCache("buckets"), net_url.QueryEscape(url))
+	if err = validateGitUrl(url); err == nil {
+		err = validateGitRef(ref)
+	}
+	if err != nil {
+		return
+	}
+
+	// either way, only ref is fetched, so each ref gets a clone of its own
+	location := url
+	if ref != "" {
+		repoPath += "@" + net_url.QueryEscape(ref)
+		location += "@" + ref
+	}
+	// without the git binary, or if a previous run cloned it that way, use the pure-Go client
+	_, lookErr := exec.LookPath("git")
+	useObjects := lookErr != nil || isBareGitRepo(repoPath)
+
+	f, statErr := os.Stat(repoPath)
+	exists := statErr == nil && (isBareGitRepo(repoPath) || isGitCheckout(repoPath))
+	age := time.Duration(0)
+	if exists {
+		age = time.Since(f.ModTime())
+	}
+
+	// offline, use the repo as it was last fetched
+	if g_Offline {
+		if !exists {
+			return repoPath, fmt.Errorf("%w of %s", ErrOfflineNoCache, location)
+		}
+		fmt.Fprintf(out, colorize("source.status", "offline, using %s old cache: %s\n"), fmtDuration(age), repoPath)
+		touchCacheMeta(out, repoPath, location, loadCacheMeta(repoPath))
+		recordCacheAge(url, age)
+		return
+	}
+
+	if exists && age <= g_CacheDuration {
+		fmt.Fprintf(out, colorize("source.status", "using %s old cache: %s\n"), fmtDuration(age), repoPath)
+		touchCacheMeta(out, repoPath, location, loadCacheMeta(repoPath))
+		recordCacheAge(url, age)
+		return
+	}
+
+	if useObjects {
+		err = cacheGitRepoObjects(out, url, ref, repoPath)
+	} else {
+		err = cacheGitCheckout(out, url, ref, repoPath, exists)
+	}
+	if err != nil {
+		if !exists {
+			// a clone that failed part way would look like a cache next time
+			os.RemoveAll(repoPath)
+			return repoPath, err
+		}
+		// error fetching, but we have a stale cache we can use
+		fmt.Fprintf(out, colorize("error", "*** %s: %s\n"), location, err)
+		fmt.Fprintf(out, "Failed to fetch, so using %s old cache: %s\n", fmtDuration(age), repoPath)
+		touchCacheMeta(out, repoPath, location, loadCacheMeta(repoPath))
+		recordCacheAge(url, age)
+		return repoPath, nil
+	}
+
+	touchCacheMeta(out, repoPath, location, loadCacheMeta(repoPath))
+	markGitRepoUpdated(url, repoPath)
+	return
+}
+
+// fetches the one commit of ref (or HEAD) without its history or blobs, then checks out only the manifests, which fetches their blobs.
+// A new clone is set up with `git init` first, so nothing runs in repoPath before it exists.
+func cacheGitCheckout(out io.Writer, url string, ref string, repoPath string, exists bool) error {
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	if exists {
+		logTo(out, "Updating repository cache: "+repoPath)
 	} else {
-		cmdline = []string{"git", "pull"}
-		log.Println("Updating repository cache: " + repoPath)
+		logTo(out, "Cloning repository: "+url)
+		if err := runGit(out, url, "", "init", "--quiet", "--template=", "--", repoPath); err != nil {
+			return err
+		}
+		if err := runGit(out, url, repoPath, "remote", "add", "--", "origin", url); err != nil {
+			return err
+		}
+	}
+
+	// set every time, since clones by older versions aren't sparse
+	infoDir := filepath.Join(repoPath, ".git", "info")
+	if err := os.MkdirAll(infoDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(infoDir, "sparse-checkout"), []byte(strings.Join(g_GitSparsePatterns, "\n")+"\n"), 0600); err != nil {
+		return err
 	}
+	if err := runGit(out, url, repoPath, "config", "core.sparseCheckout", "true"); err != nil {
+		return err
+	}
+
+	if err := runGit(out, url, repoPath, "fetch", "--quiet", "--depth", "1", "--filter=blob:none", "--", "origin", ref); err != nil {
+		return err
+	}
+	return runGit(out, url, repoPath, "checkout", "--quiet", "--force", "FETCH_HEAD", "--")
+}
+
+func isGitCheckout(repoPath string) bool {
+	_, err := os.Stat(filepath.Join(repoPath, ".git"))
+	return err == nil
+}
+
+// the repo folder's time is when it was last fetched, for its age when offline and in `scoops cache list`
+func markGitRepoUpdated(url string, repoPath string) {
+	now := time.Now()
+	os.Chtimes(repoPath, now, now)
+	recordCacheAge(url, 0)
+}
+
+// the environment for running git on url, with our proxy, TLS and auth settings passed as GIT_CONFIG_* variables
+func gitEnv(out io.Writer, url string) []string {
+	config, env := gitProxyConfig(url)
+	config = append(append(config, gitTLSConfig(out, url)...), gitAuthConfig(url)...)
+	return append(append(os.Environ(), env...), gitConfigEnv(append(config, g_GitSafeConfig...)...)...)
+}
+
+// no hooks or templates, even if the user's git config has them
+var g_GitSafeConfig = []string{"core.hooksPath", os.DevNull, "init.templateDir", ""}
+
+//---------------------------------------------------------
+// git subprocesses
+//---------------------------------------------------------
+
+// -git-timeout: for each git command, so a stalled clone or fetch doesn't hang the search
+var g_GitTimeout = 5 * time.Minute
 
-	cmd := exec.Command(cmdline[0], cmdline[1:]...)
+// how long a git that exited (or was killed) may keep its output open
+const g_GitWaitDelay = 2 * time.Second
+
+// the transports git may use.  Others, like ext:: which runs a command, are refused
+const g_GitAllowProtocol = "file:git:http:https:ssh"
+
+// the urls git is given: scheme://... or scp-like [user@]host:path, and never an option
+var g_GitUrlRE = regexp.MustCompile(`^(?:(?:https?|git|ssh|file)://[^\s]+|[\w.-]+@[\w.-]+:[^\s]+)$`)
+
+func validateGitUrl(url string) error {
+	if strings.HasPrefix(url, "-") || !g_GitUrlRE.MatchString(url) {
+		return fmt.Errorf("not a git url: %q", url)
+	}
+	return nil
+}
+
+func validateGitRef(ref string) error {
+	if strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, " \t\n\r\\:?*[~^") || strings.Contains(ref, "..") {
+		return fmt.Errorf("not a git ref: %q", ref)
+	}
+	return nil
+}
+
+// runs git for url in dir (if not empty), non-interactively, without hooks, and with a timeout.
+// The error includes what git printed to stderr
+func runGit(out io.Writer, url string, dir string, args ...string) error {
+	_, err := runGitEnv(out, gitEnv(out, url), dir, args...)
+	return err
+}
+
+// runs git with env (plus the non-interactive settings), returning what it printed to stdout
+func runGitEnv(out io.Writer, env []string, dir string, args ...string) (output string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g_GitTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(env,
+		"GIT_TERMINAL_PROMPT=0", // fail instead of asking for credentials
+		"GCM_INTERACTIVE=never", // and so does git credential manager, instead of opening a window
+		"GIT_ALLOW_PROTOCOL="+g_GitAllowProtocol,
+	)
+	// a killed git's children (like git-remote-https on windows) can keep its output open, so don't wait for them
+	cmd.WaitDelay = g_GitWaitDelay
+	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
-	cmd.Stderr = &stdout // &stderr
-	cmd.Dir = repoPath
+	cmd.Stderr = &stderr
+	if DEBUG {
+		fmt.Fprintf(out, colorize("debug", "GIT")+": git %s\n", strings.Join(args, " "))
+	}
+
 	err = cmd.Run()
-	fmt.Println(stdout.String())
+	if DEBUG && stdout.Len() > 0 {
+		fmt.Fprint(out, stdout.String())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("git %s: timed out after %s", args[0], g_GitTimeout)
+	}
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("git %s: %w: %s", args[0], err, message)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
+
+// passes key, value pairs of git config without putting them on the command line, after any already in the environment
+func gitConfigEnv(pairs ...string) (env []string) {
+	count, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	for i := 0; i+1 < len(pairs); i += 2 {
+		env = append(env, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", count, pairs[i]), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, pairs[i+1]))
+		count++
+	}
+	return append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", count))
+}
+
+// a bare repo has its HEAD at the root instead of in .git/
+func isBareGitRepo(repoPath string) bool {
+	_, err := os.Stat(filepath.Join(repoPath, "HEAD"))
+	return err == nil
+}
 
+// clones (bare) or fetches the one commit of ref (or HEAD) without the git binary.  go-git can't fetch a commit by its hash,
+// so a ref that is neither a branch nor a tag gets a full clone
+func cacheGitRepoObjects(out io.Writer, url string, ref string, repoPath string) (err error) {
+	installGitHttpClient()
+	ctx, cancel := context.WithTimeout(withOutput(context.Background(), out), g_GitTimeout)
+	defer cancel()
+
+	repo, err := git.PlainOpen(repoPath)
+	if err == git.ErrRepositoryNotExists {
+		logTo(out, "Cloning repository objects: "+url)
+		for _, name := range gitRefNames(ref) {
+			_, err = git.PlainCloneContext(ctx, repoPath, true, &git.CloneOptions{URL: url, ReferenceName: name, SingleBranch: true, Depth: 1, Tags: git.NoTags})
+			if !errors.Is(err, git.NoMatchingRefSpecError{}) {
+				return
+			}
+			os.RemoveAll(repoPath)
+		}
+		_, err = git.PlainCloneContext(ctx, repoPath, true, &git.CloneOptions{URL: url, Tags: git.AllTags})
+		return
+	}
 	if err != nil {
-		fmt.Printf(colorize("error", "*** %s\nTrying to continue anyway..."), err)
+		return
 	}
 
+	// the refspec of the clone fetches just its ref
+	logTo(out, "Fetching repository objects: "+repoPath)
+	err = repo.FetchContext(ctx, &git.FetchOptions{Depth: 1, Tags: git.NoTags, Force: true})
+	if err == git.NoErrAlreadyUpToDate {
+		err = nil
+	}
 	return
 }
 
-// Clones a Git repo and loades its apps
-func loadAppListFromGitRepoUrl(url string) (appList AppList) {
-	fmt.Printf("loadAppListFromGitRepoUrl: %s\n", url)
-	path := cacheGitRepo(url)
-	return loadAppListFromDir(path)
+// the names ref may have on the remote: HEAD when there is no ref, or else a branch or a tag
+func gitRefNames(ref string) []plumbing.ReferenceName {
+	if ref == "" {
+		return []plumbing.ReferenceName{plumbing.HEAD}
+	}
+	return []plumbing.ReferenceName{plumbing.NewBranchReferenceName(ref), plumbing.NewTagReferenceName(ref)}
+}
+
+// Clones a Git repo and loades its apps at ref (or HEAD)
+func loadAppListFromGitRepoUrl(out io.Writer, url string, ref string) (appList AppList, err error) {
+	fmt.Fprintf(out, "loadAppListFromGitRepoUrl: %s\n", url)
+	path, err := cacheGitRepo(out, url, ref)
+	if err != nil {
+		return
+	}
+	// a clone of just ref is checked out at it, and may have no name for it
+	if isGitCheckout(path) && ref != "" {
+		return loadAppListFromGitObjects(out, path, "")
+	}
+	return loadAppListFromGitObjects(out, path, ref)
 }
 
 //=========================================================
-// CACHE management for network requests
+// Git objects: Load a Bucket's App List straight from a repo's objects (no checkout or git binary)
 //=========================================================
 
-var g_CacheDuration time.Duration = 24 * time.Hour
+// reads the manifests in the tree of ref (or HEAD) from a bare repo, a repo with a .git folder, or a .pack file.
+// The apps are indexed by the commit, or by the packfile since it must be read entirely to find the commit.
+func loadAppListFromGitObjects(out io.Writer, path string, ref string) (appList AppList, err error) {
+	key := path
+	if ref != "" {
+		key += "@" + ref
+	}
 
-//func init() {
-//	g_CacheDuration = 24 * time.Hour
-//}
+	if strings.HasSuffix(path, ".pack") {
+		return indexedAppList(out, key, cacheRevision(path), func() (AppList, error) {
+			repo, err := openGitPackfile(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			commit, err := resolveGitCommit(repo, ref)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			return loadAppListFromGitCommit(out, path, commit)
+		})
+	}
 
-func scoopCache(category string) (cachePath string) {
-	cachePath = filepath.Join(g_Config.ScoopCacheDir, category)
-	checkWith(os.MkdirAll(cachePath, 0700), "Can't create cache directory: "+cachePath)
-	return
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	commit, err := resolveGitCommit(repo, ref)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return indexedAppList(out, key, "git:"+commit.Hash.String(), func() (AppList, error) {
+		return loadAppListFromGitCommit(out, path, commit)
+	})
 }
 
-func cacheGetUrl(cacheFilePath string, url string) (err error) {
-	err = nil
+// reads the manifests in the commit's tree
+func loadAppListFromGitCommit(out io.Writer, path string, commit *object.Commit) (appList AppList, err error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
 
-	now := time.Now()
-	f, err := os.Stat(cacheFilePath)
-	cache_exists := !os.IsNotExist(err)
+	// only search *.json in bucket/ or root, without reading the other blobs, which a sparse clone doesn't have.
+	// The objects are read in order, since the repo's storage isn't safe for concurrent use, then parsed on the worker pool
+	var jobs []manifestJob
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if !entry.Mode.IsFile() || !g_AppManifestPathRE.MatchString(name) {
+			continue
+		}
 
-	age := time.Duration(0)
-	if cache_exists {
-		age = now.Sub(f.ModTime())
-	}
-
-	if !cache_exists || g_CacheDuration < age {
-		fmt.Printf("Downloading: %s\n", url)
-
-		cli := http.Client{}
-		if g_Config.ScoopProxy != "" {
-			// https://github.com/ScoopInstaller/Scoop/wiki/Using-Scoop-behind-a-proxy#config-examples
-			proxy := "http://" + g_Config.ScoopProxy
-			url, err := net_url.Parse(proxy)
-			// todo proxy password containing `@` or `:`
-			if err == nil {
-				transport := &http.Transport{Proxy: http.ProxyURL(url)}
-				cli.Transport = transport
-
-				switch tv := http.DefaultTransport.(type) {
-				case *http.Transport:
-					{
-						transport.DialContext = tv.DialContext
-						transport.ForceAttemptHTTP2 = tv.ForceAttemptHTTP2
-						transport.MaxIdleConns = tv.MaxIdleConns
-						transport.IdleConnTimeout = tv.IdleConnTimeout
-						transport.TLSHandshakeTimeout = tv.TLSHandshakeTimeout
-						transport.ExpectContinueTimeout = tv.ExpectContinueTimeout
-					}
-				}
+		body, err := readGitBlob(tree, &entry)
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			if DEBUG {
+				fmt.Fprintf(out, colorize("debug", "GIT")+": skipping %s:%s, which isn't fetched\n", path, name)
 			}
+			continue
 		}
-
-		response, err := cli.Get(url)
-		if err != nil { // default to cache
-			return err
+		if err != nil {
+			return nil, fmt.Errorf("%s:%s: %w", path, name, err)
 		}
-		defer response.Body.Close()
 
-		if response.StatusCode != 200 {
-			log.Fatalf("failed to fetch data: %d %s", response.StatusCode, response.Status)
-		}
+		_, filename := filepath.Split(name)
+		jobs = append(jobs, manifestJob{
+			filePath: fmt.Sprintf("%s:%s", path, name),
+			name:     filename[:len(filename)-5], // remove ".json"
+			read:     func() ([]byte, error) { return body, nil },
+		})
+	}
+	return loadAppsFromManifests(out, jobs)
+}
 
-		cacheFile, err := os.Create(cacheFilePath)
-		checkWith(err, "Couldn't create cache file")
+func readGitBlob(tree *object.Tree, entry *object.TreeEntry) ([]byte, error) {
+	file, err := tree.TreeEntryFile(entry)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
 
-		// save to cache file
-		_, err = io.Copy(cacheFile, response.Body)
-		checkWith(err, "Couldn't write to cache file")
+// resolves ref (branch, tag, or commit hash) to a commit.
+// An empty ref is HEAD, preferring its remote-tracking branch since bare clones only fetch into refs/remotes/origin/
+func resolveGitCommit(repo *git.Repository, ref string) (commit *object.Commit, err error) {
+	if ref == "" {
+		head, err := repo.Head()
+		if err != nil {
+			// a .pack has no refs, so use its newest commit
+			return newestGitCommit(repo)
+		}
+		if head.Name().IsBranch() {
+			// a clone of just HEAD fetches it into origin/HEAD
+			for _, name := range []string{head.Name().Short(), "HEAD"} {
+				if remote, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", name), true); err == nil {
+					head = remote
+					break
+				}
+			}
+		}
+		return repo.CommitObject(head.Hash())
+	}
 
-	} else {
-		fmt.Printf(colorize("source.status", "using %s old cache: %s\n"), fmtDuration(age), cacheFilePath)
+	for _, name := range []string{"refs/remotes/origin/" + ref, ref} {
+		hash, err := repo.ResolveRevision(plumbing.Revision(name))
+		if err == nil {
+			return repo.CommitObject(*hash)
+		}
 	}
+	return nil, fmt.Errorf("unknown git ref: %s", ref)
+}
 
+func newestGitCommit(repo *git.Repository) (newest *object.Commit, err error) {
+	commits, err := repo.CommitObjects()
+	if err != nil {
+		return
+	}
+	err = commits.ForEach(func(commit *object.Commit) error {
+		if newest == nil || newest.Committer.When.Before(commit.Committer.When) {
+			newest = commit
+		}
+		return nil
+	})
+	if err == nil && newest == nil {
+		err = fmt.Errorf("no commits found")
+	}
 	return
 }
 
+// loads all objects of a .pack file into memory
+func openGitPackfile(path string) (repo *git.Repository, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	storage := memory.NewStorage()
+	err = packfile.UpdateObjectStorage(storage, file)
+	if err != nil {
+		return
+	}
+	return git.Init(storage, nil)
+}
+
 //=========================================================
 // buckets.json: load json and the buckets it references
 //=========================================================
 
 // loads a buckets.json file into a map[name]sourceUrl
-func loadNameSourceMapFromJsonFile(path string) (res NameSourceMap) {
+func loadNameSourceMapFromJsonFile(path string) (res NameSourceMap, err error) {
 	raw, err := os.ReadFile(path)
-	check(err)
-	res = loadNameSourceMapFromJson(raw)
+	if err != nil {
+		return
+	}
+	res, err = loadNameSourceMapFromJson(raw)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", path, err)
+	}
 	return
 }
 
-func loadNameSourceMapFromJson(json []byte) (res NameSourceMap) {
+func loadNameSourceMapFromJson(json []byte) (res NameSourceMap, err error) {
 	//fmt.Printf("buckets.json:\n%s\n", raw)
 
 	var parser fastjson.Parser
-	v, _ := parser.ParseBytes(json)
-	o, _ := v.Object()
+	v, err := parser.ParseBytes(json)
+	if err != nil {
+		return
+	}
+	o, err := v.Object()
+	if err != nil {
+		return
+	}
 
 	res = NameSourceMap{}
 	o.Visit(func(bucketName []byte, url *fastjson.Value) {
@@ -521,16 +1478,155 @@ func loadNameSourceMapFromJson(json []byte) (res NameSourceMap) {
 	return
 }
 
-func loadBucketsFromNameSourceJson(path string) (buckets BucketMap, err error) {
-	buckets = make(BucketMap)
-	var more_buckets BucketMap
-	nameSourceMap := loadNameSourceMapFromJsonFile(path)
-	for _, source := range nameSourceMap {
-		more_buckets, err = loadBucketsFrom("bucket", source)
-		// aggregate buckets
-		for name, appList := range more_buckets {
-			buckets[name] = appList
+// a name:source entry of a buckets.json
+type NameSource struct {
+	Name   string
+	Source string
+}
+
+// the entries of a buckets.json, in order
+func loadNameSourcesFromJson(json []byte) (entries []NameSource, err error) {
+	var parser fastjson.Parser
+	v, err := parser.ParseBytes(json)
+	if err != nil {
+		return
+	}
+	o, err := v.Object()
+	if err != nil {
+		return
+	}
+	o.Visit(func(bucketName []byte, url *fastjson.Value) {
+		entries = append(entries, NameSource{Name: string(bucketName), Source: string(url.GetStringBytes())})
+	})
+	return
+}
+
+// the entries of a buckets.json loaded at once
+const g_NameSourceJobs = 8
+
+// loads the buckets of a local or remote buckets.json of name:source pairs, like scoop's known buckets, keeping its names.
+// A source may be another buckets.json (relative to this one), which is loaded the same way.
+func loadBucketsFromNameSourceJson(out io.Writer, path string) (buckets BucketMap, err error) {
+	return loadBucketsFromNameSourceJsonIn(out, path, nil)
+}
+
+// the entries are loaded concurrently and their status printed in order.  The buckets that loaded are returned, along with how many entries didn't.
+// parents are the buckets.json files that include this one, to detect a cycle
+func loadBucketsFromNameSourceJsonIn(out io.Writer, path string, parents []string) (buckets BucketMap, err error) {
+	for _, parent := range parents {
+		if parent == path {
+			return nil, fmt.Errorf("%s: buckets.json includes itself: %s", path, strings.Join(append(parents, path), " -> "))
+		}
+	}
+	parents = append(parents[:len(parents):len(parents)], path)
+
+	filePath, err := cacheNameSourceJson(out, path)
+	if err != nil {
+		return
+	}
+	raw, err := os.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+	entries, err := loadNameSourcesFromJson(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// each entry's output is printed along with its status line, so the entries loading at once aren't mixed
+	type result struct {
+		buckets BucketMap
+		err     error
+		output  SourceOutput
+	}
+	results := make([]result, len(entries))
+	limit := make(chan struct{}, g_NameSourceJobs)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		wg.Add(1)
+		go func(i int, entry NameSource) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			// a panic in a loader only fails its own entry
+			defer func() {
+				if r := recover(); r != nil {
+					results[i].err = fmt.Errorf("%v", r)
+				}
+			}()
+			results[i].buckets, results[i].err = loadNameSource(&results[i].output, path, entry, parents)
+		}(i, entry)
+	}
+	wg.Wait()
+
+	// a nested buckets.json's entries are indented under it
+	indent := strings.Repeat("  ", len(parents))
+	buckets = BucketMap{}
+	var errs []error
+	for i, entry := range entries {
+		loaded, apps := 0, 0
+		for name, appList := range results[i].buckets {
+			if appList != nil {
+				buckets[name] = appList
+				loaded++
+				apps += len(appList)
+			}
+		}
+		results[i].output.WriteTo(out)
+		if results[i].err != nil {
+			fmt.Fprintf(out, colorize("error", "%s- %s: %s\n"), indent, entry.Name, results[i].err)
+			errs = append(errs, results[i].err)
+		} else {
+			fmt.Fprintf(out, colorize("source.status", "%s+ %s: %d apps in %d buckets\n"), indent, entry.Name, apps, loaded)
+		}
+	}
+	return buckets, partialError(errs, len(entries), "entries")
+}
+
+// loads the buckets of an entry, named after it.  A source that has many buckets names them entry/bucket,
+// except a nested buckets.json, whose buckets keep its own names
+func loadNameSource(out io.Writer, path string, entry NameSource, parents []string) (buckets BucketMap, err error) {
+	source := resolveNameSource(path, takeUrlCredentials(entry.Source))
+	if strings.HasSuffix(source, ".json") {
+		return loadBucketsFromNameSourceJsonIn(out, source, parents)
+	}
+
+	loaded, err := loadBucketsFrom(&SourceRef{Kind: "bucket", Path: source}, out)
+	buckets = BucketMap{}
+	for name, appList := range loaded {
+		if len(loaded) == 1 {
+			buckets[entry.Name] = appList
+		} else {
+			buckets[entry.Name+"/"+filepath.Base(name)] = appList
 		}
 	}
 	return
 }
+
+// a relative source is relative to the buckets.json it is in
+func resolveNameSource(path string, source string) string {
+	if isGitRemote(source) || filepath.IsAbs(source) || source == "" {
+		return source
+	}
+	if isUrl(path) {
+		if base, err := net_url.Parse(path); err == nil {
+			if relative, err := net_url.Parse(filepath.ToSlash(source)); err == nil {
+				return base.ResolveReference(relative).String()
+			}
+		}
+		return source
+	}
+	return filepath.Join(filepath.Dir(path), source)
+}
+
+// downloads a remote buckets.json to the cache, or else returns the local path
+func cacheNameSourceJson(out io.Writer, url string) (filePath string, err error) {
+	if !isUrl(url) {
+		return url, nil
+	}
+	filePath = filepath.Join(scoopCache("buckets"), net_url.QueryEscape(url)+".json")
+	if err = cacheGetUrlOrStale(out, filePath, url); err != nil {
+		return
+	}
+	return filePath, nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	net_url "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fastjson"
+	"modernc.org/sqlite"
+)
+
+//=========================================================
+// SQLite: Load buckets from a database of apps (zhoujin7/crawl-scoop-directory)
+//=========================================================
+
+func init() {
+	registerSourceLoader(&sourceLoader{
+		kind:        "sqlite",
+		description: "a local or remote sqlite database of apps, like zhoujin7/crawl-scoop-directory (*.sqlite, *.sqlite3, *.db)",
+		match: func(src *SourceRef) bool {
+			return src.Kind == "sqlite" || src.isAutoKind() && hasAnySuffix(src.Path, ".sqlite", ".sqlite3", ".db")
+		},
+		load: func(src *SourceRef, out io.Writer) (BucketMap, error) {
+			return loadBucketsFromSqlite(out, localOrUrlPath(src.Path), g_State.Query)
+		},
+	})
+
+	// lets the query prefilter rows with `column REGEXP pattern`, using go's regexp syntax
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, sqliteRegexp)
+	sqlite.MustRegisterDeterministicScalarFunction("regexp_bins", 2, sqliteRegexpBins)
+}
+
+// compiled REGEXP patterns, since sqlite calls the function once per row
+var g_SqliteRegexps sync.Map
+
+// implements `text REGEXP pattern`, which sqlite calls as regexp(pattern, text)
+func sqliteRegexp(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	return sqliteMatch(args, func(re *regexp.Regexp, text string) bool {
+		return re.MatchString(text)
+	})
+}
+
+// implements regexp_bins(pattern, text), which matches the bins in text the way filterApp does: by file name, without the extension
+func sqliteRegexpBins(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	return sqliteMatch(args, func(re *regexp.Regexp, text string) bool {
+		for _, bin := range binsFromText(text) {
+			if re.MatchString(binSearchText(bin)) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func sqliteMatch(args []driver.Value, match func(re *regexp.Regexp, text string) bool) (driver.Value, error) {
+	pattern, _ := args[0].(string)
+	var text string
+	switch value := args[1].(type) {
+	case string:
+		text = value
+	case []byte:
+		text = string(value)
+	case nil:
+		return int64(0), nil
+	default:
+		text = fmt.Sprint(value)
+	}
+
+	re, ok := g_SqliteRegexps.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		re, _ = g_SqliteRegexps.LoadOrStore(pattern, compiled)
+	}
+
+	if match(re.(*regexp.Regexp), text) {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+// the table and columns holding the apps, found by their names
+type sqliteAppsTable struct {
+	Table       string
+	Name        string
+	Version     string
+	Description string
+	Homepage    string
+	Bins        string
+	Bucket      string // the bucket's url, or an id into BucketTable
+	BucketTable string
+	BucketId    string
+	BucketUrl   string
+}
+
+// loads the apps matching query (if any) from a sqlite database, grouped by bucket url
+func loadBucketsFromSqlite(out io.Writer, url string, query *SearchQuery) (buckets BucketMap, err error) {
+	filePath := url
+	if isUrl(url) {
+		filePath = filepath.Join(scoopCache("buckets"), net_url.QueryEscape(url)+".sqlite")
+		if err = cacheGetUrlOrStale(out, filePath, url); err != nil {
+			return
+		}
+	} // else the url is already a filepath
+
+	if _, err = os.Stat(filePath); err != nil {
+		return
+	}
+
+	// the uri's path is percent-decoded, and the cache names of urls are percent-encoded
+	uriPath := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(filepath.ToSlash(filePath))
+	db, err := sql.Open("sqlite", "file:"+uriPath+"?mode=ro")
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	table, err := findSqliteAppsTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	sqlQuery, sqlArgs := table.selectApps(query)
+	if DEBUG {
+		fmt.Fprintf(out, colorize("debug", "SQLITE")+": %s %v\n", sqlQuery, sqlArgs)
+	}
+
+	rows, err := db.Query(sqlQuery, sqlArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	defer rows.Close()
+
+	buckets = BucketMap{}
+	for rows.Next() {
+		var bucket, bins string
+		app := &AppInfo{}
+		err = rows.Scan(&app.Name, &app.Version, &app.Description, &app.Homepage, &bins, &bucket)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+		app.Bins = binsFromText(bins)
+		buckets[bucket] = append(buckets[bucket], app)
+	}
+	// the query already ran in sqlite, so only the apps of an unfiltered select have a use for trigrams
+	if query == nil {
+		registerTrigramIndexes(buckets)
+	}
+	return buckets, rows.Err()
+}
+
+// finds the table with app names and bucket urls.  A bucket id is followed into its bucket table.
+func findSqliteAppsTable(db *sql.DB) (table *sqliteAppsTable, err error) {
+	tableColumns, err := sqliteTableColumns(db)
+	if err != nil {
+		return
+	}
+
+	// visit the tables in order, so ties are always resolved the same way
+	tableNames := make([]string, 0, len(tableColumns))
+	for tableName := range tableColumns {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+
+	for _, tableName := range tableNames {
+		columns := tableColumns[tableName]
+		candidate := &sqliteAppsTable{Table: tableName}
+		for _, column := range columns {
+			label := strings.ToLower(column)
+			switch {
+			case label == "name" || label == "app" || label == "app_name" || label == "appname":
+				candidate.Name = column
+			case strings.Contains(label, "bucket") || strings.Contains(label, "repo") || label == "source":
+				candidate.Bucket = column
+			case strings.Contains(label, "name") && candidate.Name == "":
+				candidate.Name = column
+			case strings.Contains(label, "ver"):
+				candidate.Version = column
+			case strings.Contains(label, "desc"):
+				candidate.Description = column
+			case strings.Contains(label, "homepage") || strings.Contains(label, "website"):
+				candidate.Homepage = column
+			case label == "bin" || label == "bins":
+				candidate.Bins = column
+			}
+		}
+
+		// we at least need the app's name and its bucket
+		if candidate.Name == "" || candidate.Bucket == "" {
+			continue
+		}
+
+		// the bucket column may be an id into a table of buckets
+		if strings.HasSuffix(strings.ToLower(candidate.Bucket), "id") {
+			candidate.findBucketTable(tableNames, tableColumns)
+			if candidate.BucketTable == "" {
+				continue
+			}
+		}
+
+		// prefer the table with the most columns we know
+		if table == nil || candidate.numColumns() > table.numColumns() {
+			table = candidate
+		}
+	}
+
+	if table == nil {
+		err = fmt.Errorf("no table of apps with name and bucket columns")
+	}
+	return
+}
+
+// finds the buckets table for a bucket id column, with an id and a url column.
+// Tables named like "buckets" or "repos" are preferred.
+func (table *sqliteAppsTable) findBucketTable(tableNames []string, tableColumns map[string][]string) {
+	for _, preferred := range []bool{true, false} {
+		for _, tableName := range tableNames {
+			label := strings.ToLower(tableName)
+			isNamedLikeBuckets := strings.Contains(label, "bucket") || strings.Contains(label, "repo")
+			if tableName == table.Table || preferred && !isNamedLikeBuckets {
+				continue
+			}
+			id, url := "", ""
+			for _, column := range tableColumns[tableName] {
+				label := strings.ToLower(column)
+				switch {
+				case label == "id":
+					id = column
+				case strings.Contains(label, "url") || strings.Contains(label, "repo") || label == "source":
+					url = column
+				}
+			}
+			if id != "" && url != "" {
+				table.BucketTable, table.BucketId, table.BucketUrl = tableName, id, url
+				return
+			}
+		}
+	}
+}
+
+func (table *sqliteAppsTable) numColumns() (count int) {
+	for _, column := range []string{table.Version, table.Description, table.Homepage, table.Bins} {
+		if column != "" {
+			count += 1
+		}
+	}
+	return
+}
+
+// builds the SELECT of name, version, description, homepage, bins, bucket url.
+// The query's name/bins/description regexp is pushed into the WHERE clause, with bins matched like filterApp matches them
+func (table *sqliteAppsTable) selectApps(query *SearchQuery) (sqlQuery string, sqlArgs []interface{}) {
+	column := func(name string) string {
+		if name == "" {
+			return "''"
+		}
+		return "COALESCE(CAST(a." + sqliteQuote(name) + " AS TEXT), '')"
+	}
+
+	bucket := column(table.Bucket)
+	from := sqliteQuote(table.Table) + " AS a"
+	if table.BucketTable != "" {
+		bucket = "COALESCE(CAST(b." + sqliteQuote(table.BucketUrl) + " AS TEXT), '')"
+		from += " LEFT JOIN " + sqliteQuote(table.BucketTable) + " AS b ON a." + sqliteQuote(table.Bucket) + " = b." + sqliteQuote(table.BucketId)
+	}
+
+	sqlQuery = "SELECT " + strings.Join([]string{
+		column(table.Name), column(table.Version), column(table.Description), column(table.Homepage), column(table.Bins), bucket,
+	}, ", ") + " FROM " + from
+
+	if query != nil {
+		var conditions []string
+		for _, field := range query.Fields {
+			name := map[string]string{"name": table.Name, "description": table.Description, "bins": table.Bins}[field]
+			if name == "" {
+				continue
+			}
+			if field == "bins" {
+				conditions = append(conditions, "regexp_bins(?, a."+sqliteQuote(name)+")")
+			} else {
+				conditions = append(conditions, "a."+sqliteQuote(name)+" REGEXP ?")
+			}
+			sqlArgs = append(sqlArgs, query.Pattern.String())
+		}
+		if len(conditions) == 0 {
+			conditions = []string{"0"} // none of the searched fields are in the table
+		}
+		sqlQuery += " WHERE " + strings.Join(conditions, " OR ")
+	}
+	return
+}
+
+// maps each table name to its column names
+func sqliteTableColumns(db *sql.DB) (tableColumns map[string][]string, err error) {
+	rows, err := db.Query(`SELECT m.name, p.name FROM sqlite_master AS m JOIN pragma_table_info(m.name) AS p WHERE m.type IN ('table', 'view') ORDER BY m.name, p.cid`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	tableColumns = map[string][]string{}
+	for rows.Next() {
+		var table, column string
+		if err = rows.Scan(&table, &column); err != nil {
+			return
+		}
+		tableColumns[table] = append(tableColumns[table], column)
+	}
+	return tableColumns, rows.Err()
+}
+
+func sqliteQuote(identifier string) string {
+	return `"` + strings.ReplaceAll(identifier, `"`, `""`) + `"`
+}
+
+// bins are either stored as a manifest's json "bin" value or as a comma separated list
+func binsFromText(text string) (bins []string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	if text[0] == '[' || text[0] == '"' {
+		var parser fastjson.Parser
+		if value, err := parser.Parse(text); err == nil {
+			bins, _ = binsFromValue(value)
+			return
+		}
+	}
+	for _, bin := range strings.Split(text, ",") {
+		if bin = strings.TrimSpace(bin); bin != "" {
+			bins = append(bins, bin)
+		}
+	}
+	return
+}
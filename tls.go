@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	net_url "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+//=========================================================
+// TLS: extra CAs, client certificates and insecure hosts, for downloads and git
+//=========================================================
+
+// from `scoop config scoops_ca_files|scoops_client_certs|scoops_insecure_hosts`, and then -ca-file, -client-cert and -insecure-skip-verify
+type TLSOptions struct {
+	CAFiles       StringList    // PEM files of CAs to trust along with the system's, e.g. of a TLS-inspecting gateway
+	ClientCerts   ClientCertMap // for servers that require mTLS, by host
+	InsecureHosts StringList    // hosts whose certificates aren't verified at all
+}
+
+type ClientCert struct {
+	CertFile string
+	KeyFile  string // empty if the key is in CertFile
+}
+
+// host=cert.pem[,key.pem] (multiple allowed).  The host may be a glob like *.corp.example
+type ClientCertMap map[string]ClientCert
+
+func (certs *ClientCertMap) String() string {
+	entries := make([]string, 0, len(*certs))
+	for host, cert := range *certs {
+		entries = append(entries, host+"="+cert.String())
+	}
+	return strings.Join(entries, ";")
+}
+
+func (certs *ClientCertMap) Set(value string) error {
+	for _, entry := range splitList(value) {
+		host, files, found := strings.Cut(entry, "=")
+		if !found || host == "" || files == "" {
+			return fmt.Errorf("parse error `host=cert.pem[,key.pem]`: %v", entry)
+		}
+		certFile, keyFile, _ := strings.Cut(files, ",")
+		if *certs == nil {
+			*certs = ClientCertMap{}
+		}
+		(*certs)[strings.ToLower(host)] = ClientCert{CertFile: certFile, KeyFile: keyFile}
+	}
+	return nil
+}
+
+func (cert ClientCert) String() string {
+	if cert.KeyFile == "" {
+		return cert.CertFile
+	}
+	return cert.CertFile + "," + cert.KeyFile
+}
+
+// the entries of a ";" separated list
+func splitList(value string) (list []string) {
+	for _, entry := range strings.Split(value, ";") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return
+}
+
+// a host matches itself, or a glob like *.corp.example
+func matchHost(pattern string, host string) bool {
+	host, pattern = strings.ToLower(host), strings.ToLower(pattern)
+	if pattern == host {
+		return true
+	}
+	matched, _ := path.Match(pattern, host)
+	return matched
+}
+
+//---------------------------------------------------------
+// the tls.Config of each host
+//---------------------------------------------------------
+
+var g_TLSOnce sync.Once
+var g_TLSRootCAs *x509.CertPool // nil for the system's
+var g_TLSCABundle []byte        // the PEMs of the extra CA files
+var g_TLSClientCerts map[string]*tls.Certificate
+var g_TLSInsecureWarned sync.Map
+
+// loads the CA files and client certificates once.  A file that can't be loaded is reported and ignored
+func loadTLSOptions() {
+	g_TLSOnce.Do(func() {
+		options := &g_Config.TLS
+
+		if len(options.CAFiles) > 0 {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			for _, file := range options.CAFiles {
+				pem, err := os.ReadFile(file)
+				if err == nil && !pool.AppendCertsFromPEM(pem) {
+					err = fmt.Errorf("no PEM certificates in %s", file)
+				}
+				if err != nil {
+					fmt.Printf(colorize("error", "*** Ignoring CA file: %s\n"), err)
+					continue
+				}
+				g_TLSCABundle = append(append(g_TLSCABundle, bytes.TrimSpace(pem)...), '\n')
+			}
+			g_TLSRootCAs = pool
+		}
+
+		g_TLSClientCerts = map[string]*tls.Certificate{}
+		for host, files := range options.ClientCerts {
+			keyFile := files.KeyFile
+			if keyFile == "" {
+				keyFile = files.CertFile
+			}
+			cert, err := tls.LoadX509KeyPair(files.CertFile, keyFile)
+			if err != nil {
+				fmt.Printf(colorize("error", "*** Ignoring client certificate for %s: %s\n"), host, err)
+				continue
+			}
+			g_TLSClientCerts[host] = &cert
+		}
+	})
+}
+
+// the client certificate for host, and the host or glob it was given for
+func clientCertPatternOf(host string) (pattern string, cert *tls.Certificate) {
+	if cert, ok := g_TLSClientCerts[strings.ToLower(host)]; ok {
+		return strings.ToLower(host), cert
+	}
+	for pattern, cert := range g_TLSClientCerts {
+		if matchHost(pattern, host) {
+			return pattern, cert
+		}
+	}
+	return "", nil
+}
+
+// host's certificate isn't verified if it is one of the insecure hosts, and the first time that happens it is warned about
+func isInsecureHost(out io.Writer, host string) bool {
+	for _, pattern := range g_Config.TLS.InsecureHosts {
+		if matchHost(pattern, host) {
+			if _, warned := g_TLSInsecureWarned.LoadOrStore(strings.ToLower(host), true); !warned {
+				fmt.Fprintf(out, colorize("error", "*** WARNING: NOT verifying the TLS certificate of %s (insecure-skip-verify %s). Anyone between you and it can read and change what is downloaded!\n"), host, pattern)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func tlsConfigForHost(out io.Writer, host string) *tls.Config {
+	loadTLSOptions()
+	config := &tls.Config{RootCAs: g_TLSRootCAs}
+	if _, cert := clientCertPatternOf(host); cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	config.InsecureSkipVerify = isInsecureHost(out, host)
+	return config
+}
+
+//---------------------------------------------------------
+// hostTransport: a transport per host, so each gets its own client certificate and verification.
+// The auth headers of each host are added here too, so a redirect to another host doesn't get them (see auth.go)
+//---------------------------------------------------------
+
+type hostTransport struct {
+	base       *http.Transport
+	mutex      sync.Mutex
+	transports map[string]*http.Transport // by host, or "" for the hosts without options of their own
+}
+
+func newHostTransport(base *http.Transport) *hostTransport {
+	return &hostTransport{base: base, transports: map[string]*http.Transport{}}
+}
+
+func (t *hostTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return t.transportFor(outputOf(request.Context()), request.URL.Hostname()).RoundTrip(withAuth(request))
+}
+
+func (t *hostTransport) transportFor(out io.Writer, host string) *http.Transport {
+	config := tlsConfigForHost(out, host)
+	key := ""
+	if config.InsecureSkipVerify || len(config.Certificates) > 0 {
+		key = strings.ToLower(host)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	transport, ok := t.transports[key]
+	if !ok {
+		transport = t.base.Clone()
+		transport.TLSClientConfig = config
+		t.transports[key] = transport
+	}
+	return transport
+}
+
+func (t *hostTransport) CloseIdleConnections() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, transport := range t.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+//---------------------------------------------------------
+// the TLS options for git, which doesn't read scoop's config
+//---------------------------------------------------------
+
+var g_GitHttpOnce sync.Once
+
+// makes go-git download with our http client, so it has the same proxy, TLS options and timeouts
+func installGitHttpClient() {
+	g_GitHttpOnce.Do(func() {
+		gitClient := githttp.NewClient(newHttpClient())
+		client.InstallProtocol("https", gitClient)
+		client.InstallProtocol("http", gitClient)
+	})
+}
+
+// the GIT_CONFIG_* pairs that make git use our TLS options for url
+func gitTLSConfig(out io.Writer, url string) (config []string) {
+	parsed, err := net_url.Parse(url)
+	if err != nil || parsed.Scheme != "https" {
+		return
+	}
+	loadTLSOptions()
+	host := parsed.Hostname()
+	hostUrl := "http.https://" + host + "/"
+
+	pattern, cert := clientCertPatternOf(host)
+	bundle := ""
+	if len(g_TLSCABundle) > 0 {
+		bundle = gitCABundleFile(out)
+	}
+	if bundle != "" || cert != nil {
+		// git for windows uses schannel by default, which ignores http.sslCAInfo and wants client certificates in the windows store
+		config = append(config, "http.sslBackend", "openssl")
+	}
+	if bundle != "" {
+		config = append(config, "http.sslCAInfo", bundle)
+	}
+	if cert != nil {
+		files := g_Config.TLS.ClientCerts[pattern]
+		config = append(config, hostUrl+"sslCert", files.CertFile)
+		if files.KeyFile != "" {
+			config = append(config, hostUrl+"sslKey", files.KeyFile)
+		}
+	}
+	if isInsecureHost(out, host) {
+		config = append(config, hostUrl+"sslVerify", "false")
+	}
+	return
+}
+
+var g_GitCABundleOnce sync.Once
+var g_GitCABundleFile string
+
+// the system CA bundles that git's openssl may have been built to use, when git has none configured
+var g_SystemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+	"/usr/local/etc/openssl/cert.pem",
+}
+
+// http.sslCAInfo replaces git's CAs rather than adding to them, so the extra CAs are saved along with git's own.
+// Without git's own bundle, sslCAInfo would make git distrust every public CA, so the extra CAs aren't given to git.
+func gitCABundleFile(out io.Writer) string {
+	g_GitCABundleOnce.Do(func() {
+		caInfo := gitDefaultCABundle(out)
+		pem, err := os.ReadFile(caInfo)
+		if caInfo == "" || err != nil {
+			fmt.Fprintln(out, colorize("error", "*** WARNING: git's CA bundle wasn't found, so git isn't given the -ca-file CAs"))
+			return
+		}
+		bundle := append(append(bytes.TrimSpace(pem), '\n'), g_TLSCABundle...)
+		file := filepath.Join(scoopCache("tls"), "ca-bundle.pem")
+		if err := writeFileAtomic(file, bytes.NewReader(bundle), nil); err != nil {
+			fmt.Fprintf(out, colorize("error", "*** Couldn't save the CA bundle for git: %s\n"), err)
+			return
+		}
+		g_GitCABundleFile = file
+	})
+	return g_GitCABundleFile
+}
+
+// the CA bundle git uses: $env:GIT_SSL_CAINFO, its http.sslCAInfo config, the one installed with git for windows, or the system's
+func gitDefaultCABundle(out io.Writer) string {
+	if caInfo := os.Getenv("GIT_SSL_CAINFO"); caInfo != "" {
+		return caInfo
+	}
+	env := append(os.Environ(), gitConfigEnv(g_GitSafeConfig...)...)
+	if caInfo, err := runGitEnv(out, env, "", "config", "--get", "http.sslCAInfo"); err == nil && strings.TrimSpace(caInfo) != "" {
+		return strings.TrimSpace(caInfo)
+	}
+
+	var candidates []string
+	if execPath, err := runGitEnv(out, env, "", "--exec-path"); err == nil && strings.TrimSpace(execPath) != "" {
+		// git for windows: <git>\mingw64\libexec\git-core, with its bundle in <git>\mingw64\etc\ssl\certs (or ssl\certs when older)
+		prefix := filepath.Dir(filepath.Dir(strings.TrimSpace(execPath)))
+		candidates = append(candidates,
+			filepath.Join(prefix, "etc", "ssl", "certs", "ca-bundle.crt"),
+			filepath.Join(prefix, "ssl", "certs", "ca-bundle.crt"))
+	}
+	candidates = append(candidates, g_SystemCABundles...)
+	for _, candidate := range candidates {
+		if f, err := os.Stat(candidate); err == nil && !f.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
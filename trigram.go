@@ -0,0 +1,521 @@
+package main
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+//=========================================================
+// TRIGRAMS: skip the apps that can't match a query, like google/codesearch.
+// A regexp's matches must contain certain trigrams (3 byte substrings), so only the apps
+// whose fields contain them are matched against the regexp.
+//=========================================================
+
+// TrigramIndex lists, for each searchable field, the apps of a bucket containing each trigram.
+// It is saved with the bucket's IndexEntry.
+type TrigramIndex struct {
+	NumApps  int
+	Postings map[string][]byte // field -> encodePostings()
+}
+
+// the TrigramIndex of each indexed AppList, by the list's first app
+var g_TrigramIndexes sync.Map
+
+func registerTrigramIndex(apps AppList, index *TrigramIndex) {
+	if len(apps) > 0 && index != nil {
+		g_TrigramIndexes.Store(apps[0], index)
+	}
+}
+
+// builds and registers the TrigramIndex of each bucket whose apps aren't saved in an index, so they are prefiltered too
+func registerTrigramIndexes(buckets BucketMap) {
+	for _, apps := range buckets {
+		if len(apps) > 0 {
+			registerTrigramIndex(apps, buildTrigramIndex(apps))
+		}
+	}
+}
+
+func trigramIndexOf(apps AppList) *TrigramIndex {
+	if len(apps) == 0 {
+		return nil
+	}
+	if value, ok := g_TrigramIndexes.Load(apps[0]); ok {
+		if index := value.(*TrigramIndex); index.NumApps == len(apps) {
+			return index
+		}
+	}
+	return nil
+}
+
+// the text of a bin that is searched: its file name without the extension
+func binSearchText(bin string) string {
+	bin = filepath.Base(bin)
+	return strings.TrimSuffix(bin, filepath.Ext(bin))
+}
+
+// only ascii is case folded, so that the bytes (and trigrams) of the text are unchanged otherwise
+func foldASCII(text string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, text)
+}
+
+func trigramAt(text string, i int) uint32 {
+	return uint32(text[i])<<16 | uint32(text[i+1])<<8 | uint32(text[i+2])
+}
+
+func buildTrigramIndex(apps AppList) *TrigramIndex {
+	fields := map[string]map[uint32][]uint32{"name": {}, "bins": {}, "description": {}}
+
+	add := func(field string, ordinal uint32, text string) {
+		postings := fields[field]
+		text = foldASCII(text)
+		for i := 0; i+3 <= len(text); i++ {
+			trigram := trigramAt(text, i)
+			list := postings[trigram]
+			if len(list) == 0 || list[len(list)-1] != ordinal {
+				postings[trigram] = append(list, ordinal)
+			}
+		}
+	}
+
+	for i, app := range apps {
+		ordinal := uint32(i)
+		add("name", ordinal, app.Name)
+		// the bins of every architecture, so the index doesn't depend on -arch
+		for _, bin := range app.binsForArch("all") {
+			add("bins", ordinal, binSearchText(bin.Bin))
+		}
+		add("description", ordinal, app.Description)
+	}
+
+	index := &TrigramIndex{NumApps: len(apps), Postings: map[string][]byte{}}
+	for field, postings := range fields {
+		index.Postings[field] = encodePostings(postings)
+	}
+	return index
+}
+
+// each trigram in order as: the delta from the previous trigram, the number of apps, and the deltas of the app ordinals
+func encodePostings(postings map[uint32][]uint32) []byte {
+	trigrams := make([]uint32, 0, len(postings))
+	for trigram := range postings {
+		trigrams = append(trigrams, trigram)
+	}
+	sort.Slice(trigrams, func(i, j int) bool { return trigrams[i] < trigrams[j] })
+
+	var buf []byte
+	previous := uint32(0)
+	for _, trigram := range trigrams {
+		list := postings[trigram]
+		buf = binary.AppendUvarint(buf, uint64(trigram-previous))
+		buf = binary.AppendUvarint(buf, uint64(len(list)))
+		last := uint32(0)
+		for _, ordinal := range list {
+			buf = binary.AppendUvarint(buf, uint64(ordinal-last))
+			last = ordinal
+		}
+		previous = trigram
+	}
+	return buf
+}
+
+// decodes the app ordinals of just the wanted trigrams
+func decodePostings(buf []byte, wanted map[uint32]bool) map[uint32][]uint32 {
+	postings := map[uint32][]uint32{}
+	next := func() uint32 {
+		value, n := binary.Uvarint(buf)
+		if n <= 0 {
+			buf = nil
+			return 0
+		}
+		buf = buf[n:]
+		return uint32(value)
+	}
+
+	trigram := uint32(0)
+	for len(buf) > 0 {
+		trigram += next()
+		count := int(next())
+		var list []uint32
+		ordinal := uint32(0)
+		for i := 0; i < count && len(buf) > 0; i++ {
+			ordinal += next()
+			if wanted[trigram] {
+				list = append(list, ordinal)
+			}
+		}
+		if wanted[trigram] {
+			postings[trigram] = list
+		}
+	}
+	return postings
+}
+
+// reports which apps may match the query, or nil if they all may (or the apps aren't indexed)
+func trigramCandidates(query *SearchQuery, apps AppList) (candidates []bool) {
+	index := trigramIndexOf(apps)
+	if index == nil {
+		return nil
+	}
+	q := trigramQueryOf(query.Pattern.String())
+	if q.op == tqAll {
+		return nil
+	}
+
+	wanted := map[uint32]bool{}
+	q.addTrigramsTo(wanted)
+
+	candidates = make([]bool, len(apps))
+	for _, field := range query.Fields {
+		buf, ok := index.Postings[field]
+		if !ok {
+			return nil
+		}
+		ordinals, all := q.eval(decodePostings(buf, wanted))
+		if all {
+			return nil
+		}
+		for _, ordinal := range ordinals {
+			if int(ordinal) < len(candidates) {
+				candidates[ordinal] = true
+			}
+		}
+	}
+	return candidates
+}
+
+//=========================================================
+// trigramQuery: the trigrams that any match of a regexp must contain
+//=========================================================
+
+const (
+	tqAll  = iota // any text may match
+	tqNone        // no text can match
+	tqAnd         // all of the trigrams and subs
+	tqOr          // any of the trigrams or subs
+)
+
+type trigramQuery struct {
+	op       int
+	trigrams []uint32
+	subs     []*trigramQuery
+}
+
+// queries by pattern, since every bucket is filtered by the same one
+var g_TrigramQueries sync.Map
+
+func trigramQueryOf(pattern string) *trigramQuery {
+	if value, ok := g_TrigramQueries.Load(pattern); ok {
+		return value.(*trigramQuery)
+	}
+	q := &trigramQuery{op: tqAll}
+	if re, err := syntax.Parse(pattern, syntax.Perl); err == nil {
+		q = analyzeRegexp(re.Simplify())
+	}
+	g_TrigramQueries.Store(pattern, q)
+	return q
+}
+
+func (q *trigramQuery) addTrigramsTo(trigrams map[uint32]bool) {
+	for _, trigram := range q.trigrams {
+		trigrams[trigram] = true
+	}
+	for _, sub := range q.subs {
+		sub.addTrigramsTo(trigrams)
+	}
+}
+
+// the sorted ordinals of the apps whose postings satisfy the query, or all
+func (q *trigramQuery) eval(postings map[uint32][]uint32) (ordinals []uint32, all bool) {
+	switch q.op {
+	case tqAll:
+		return nil, true
+	case tqNone:
+		return nil, false
+	case tqAnd:
+		all = true
+		for _, trigram := range q.trigrams {
+			ordinals, all = intersectOrdinals(ordinals, all, postings[trigram]), false
+		}
+		for _, sub := range q.subs {
+			subOrdinals, subAll := sub.eval(postings)
+			if !subAll {
+				ordinals, all = intersectOrdinals(ordinals, all, subOrdinals), false
+			}
+		}
+		return
+	default: // tqOr
+		for _, trigram := range q.trigrams {
+			ordinals = unionOrdinals(ordinals, postings[trigram])
+		}
+		for _, sub := range q.subs {
+			subOrdinals, subAll := sub.eval(postings)
+			if subAll {
+				return nil, true
+			}
+			ordinals = unionOrdinals(ordinals, subOrdinals)
+		}
+		return
+	}
+}
+
+func intersectOrdinals(a []uint32, aAll bool, b []uint32) (res []uint32) {
+	if aAll {
+		return b
+	}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return
+}
+
+func unionOrdinals(a []uint32, b []uint32) (res []uint32) {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || i < len(a) && a[i] < b[j]:
+			res = append(res, a[i])
+			i++
+		case i == len(a) || b[j] < a[i]:
+			res = append(res, b[j])
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return
+}
+
+func andQuery(subs []*trigramQuery) *trigramQuery {
+	q := &trigramQuery{op: tqAnd}
+	for _, sub := range subs {
+		switch sub.op {
+		case tqAll:
+		case tqNone:
+			return sub
+		case tqAnd:
+			q.trigrams = append(q.trigrams, sub.trigrams...)
+			q.subs = append(q.subs, sub.subs...)
+		default:
+			q.subs = append(q.subs, sub)
+		}
+	}
+	if len(q.trigrams) == 0 && len(q.subs) == 0 {
+		return &trigramQuery{op: tqAll}
+	}
+	return q
+}
+
+func orQuery(subs []*trigramQuery) *trigramQuery {
+	q := &trigramQuery{op: tqOr}
+	for _, sub := range subs {
+		switch sub.op {
+		case tqAll:
+			return sub
+		case tqNone:
+		case tqOr:
+			q.trigrams = append(q.trigrams, sub.trigrams...)
+			q.subs = append(q.subs, sub.subs...)
+		default:
+			if sub.op == tqAnd && len(sub.trigrams) == 1 && len(sub.subs) == 0 {
+				q.trigrams = append(q.trigrams, sub.trigrams[0])
+			} else {
+				q.subs = append(q.subs, sub)
+			}
+		}
+	}
+	if len(q.trigrams) == 0 && len(q.subs) == 0 {
+		return &trigramQuery{op: tqNone}
+	}
+	return q
+}
+
+// a match of any of the strings must contain all of its trigrams
+func stringsQuery(texts []string) *trigramQuery {
+	var subs []*trigramQuery
+	for _, text := range texts {
+		if len(text) < 3 {
+			return &trigramQuery{op: tqAll}
+		}
+		q := &trigramQuery{op: tqAnd}
+		for i := 0; i+3 <= len(text); i++ {
+			q.trigrams = append(q.trigrams, trigramAt(text, i))
+		}
+		subs = append(subs, q)
+	}
+	return orQuery(subs)
+}
+
+// the trigrams required by a regexp.  Runs of concatenated exact strings are joined, so their trigrams span them.
+func analyzeRegexp(re *syntax.Regexp) *trigramQuery {
+	if texts, ok := exactStrings(re); ok {
+		return stringsQuery(texts)
+	}
+
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return &trigramQuery{op: tqNone}
+	case syntax.OpCapture, syntax.OpPlus:
+		return analyzeRegexp(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return analyzeRegexp(re.Sub[0])
+		}
+	case syntax.OpAlternate:
+		var subs []*trigramQuery
+		for _, sub := range re.Sub {
+			subs = append(subs, analyzeRegexp(sub))
+		}
+		return orQuery(subs)
+	case syntax.OpConcat:
+		var parts []*trigramQuery
+		var run []string
+		for _, sub := range re.Sub {
+			texts, ok := exactStrings(sub)
+			if ok && run != nil {
+				if joined := joinExactStrings(run, texts); joined != nil {
+					run = joined
+					continue
+				}
+			}
+			if run != nil {
+				parts = append(parts, stringsQuery(run))
+				run = nil
+			}
+			if ok {
+				run = texts
+			} else {
+				parts = append(parts, analyzeRegexp(sub))
+			}
+		}
+		if run != nil {
+			parts = append(parts, stringsQuery(run))
+		}
+		return andQuery(parts)
+	}
+	return &trigramQuery{op: tqAll}
+}
+
+// keeps the sets of exact strings small
+const g_MaxExactStrings = 16
+
+// the (ascii folded) strings a regexp can match, if there are only a few
+func exactStrings(re *syntax.Regexp) (texts []string, ok bool) {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return []string{""}, true
+	case syntax.OpLiteral:
+		texts = []string{""}
+		for _, r := range re.Rune {
+			runes := []rune{r}
+			if re.Flags&syntax.FoldCase != 0 {
+				for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+					runes = append(runes, f)
+				}
+			}
+			if texts = joinExactStrings(texts, runeStrings(runes)); texts == nil {
+				return nil, false
+			}
+		}
+		return texts, true
+	case syntax.OpCharClass:
+		var runes []rune
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				if len(runes) >= g_MaxExactStrings {
+					return nil, false
+				}
+				runes = append(runes, r)
+			}
+		}
+		texts = runeStrings(runes)
+		return texts, len(texts) > 0
+	case syntax.OpCapture:
+		return exactStrings(re.Sub[0])
+	case syntax.OpQuest:
+		if texts, ok = exactStrings(re.Sub[0]); ok && len(texts) < g_MaxExactStrings {
+			return uniqueStrings(append(texts, "")), true
+		}
+	case syntax.OpConcat:
+		texts = []string{""}
+		for _, sub := range re.Sub {
+			subTexts, ok := exactStrings(sub)
+			if !ok {
+				return nil, false
+			}
+			if texts = joinExactStrings(texts, subTexts); texts == nil {
+				return nil, false
+			}
+		}
+		return texts, true
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			subTexts, ok := exactStrings(sub)
+			if !ok {
+				return nil, false
+			}
+			if texts = uniqueStrings(append(texts, subTexts...)); len(texts) > g_MaxExactStrings {
+				return nil, false
+			}
+		}
+		return texts, true
+	}
+	return nil, false
+}
+
+// every a followed by every b, or nil if there would be too many
+func joinExactStrings(a []string, b []string) (texts []string) {
+	if len(a)*len(b) > g_MaxExactStrings {
+		return nil
+	}
+	for _, x := range a {
+		for _, y := range b {
+			texts = append(texts, x+y)
+		}
+	}
+	return uniqueStrings(texts)
+}
+
+func runeStrings(runes []rune) (texts []string) {
+	for _, r := range runes {
+		if !utf8.ValidRune(r) {
+			continue
+		}
+		texts = append(texts, foldASCII(string(r)))
+	}
+	return uniqueStrings(texts)
+}
+
+func uniqueStrings(texts []string) (unique []string) {
+	seen := map[string]bool{}
+	for _, text := range texts {
+		if !seen[text] {
+			seen[text] = true
+			unique = append(unique, text)
+		}
+	}
+	return
+}
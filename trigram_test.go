@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// the apps searched by the tests, made anew for each search since filterApp changes their bins
+func trigramTestApps() AppList {
+	return AppList{
+		{Name: "7zip", Description: "A file archiver with a high compression ratio", Bins: []string{"7z.exe", "7zFM.exe"}},
+		{Name: "git", Description: "Distributed version control system", Bins: []string{"bin\\git.exe", "git-bash.exe"}},
+		{Name: "GitHub-CLI", Description: "GitHub on the command line", Bins: []string{"bin/gh.exe"}},
+		{Name: "python", Description: "A programming language", Bins: []string{"python.exe", "Scripts\\pip.exe"}},
+		{Name: "ruby", Description: "A dynamic language, rb for short", Bins: []string{"bin\\ruby.exe", "bin\\irb.bat"}},
+		{Name: "foobaz", Description: "Foo and baz", Bins: []string{"foo.exe"}},
+		{Name: "barbaz", Description: "Bar and baz", Bins: []string{"bar.cmd"}},
+		{Name: "winrar", Description: "RAR and ZIP archives", Architectures: map[string]*AppArchitecture{
+			"64bit": {Bins: []string{"x64\\rar.exe"}},
+			"32bit": {Bins: []string{"x86\\rar32.exe"}},
+		}},
+		{Name: "qr", Description: "Makes QR codes", Bins: []string{"qrencode.exe"}},
+		{Name: "Ünïcödé-Tool", Description: "Ünïcödé names and ÄÖÜ", Bins: []string{"ünï.exe"}},
+		{Name: "straße", Description: "Die Straße", Bins: []string{"STRASSE.exe"}},
+		{Name: "ſed", Description: "a stream editor spelled with a long s"},
+		{Name: "Kelvin", Description: "spelled with the kelvin sign K"},
+		{Name: "numbers", Description: "version 12 of 2024"},
+	}
+}
+
+func appNames(apps AppList) (names []string) {
+	for _, app := range apps {
+		names = append(names, app.Name)
+	}
+	return
+}
+
+// the trigram index only skips apps, so filterAppList must match the same apps with it as without it
+func TestTrigramIndexMatchesRegexp(t *testing.T) {
+	patterns := []string{
+		// anchored
+		"^7z$", "^git", "baz$", "^$", `\bqr\b`, `^git-?hub`,
+		// alternation
+		"zip|rar", "(foo|bar)baz", "^(py|rb)thon", "(rb|irb)$", "a(rch|rar)ive", "x(64|86)",
+		// case sensitive
+		"(?-i)Git", "(?-i)git", "(?-i)ZIP", "(?-i)(?i:zip)",
+		// non-ascii, and the unicode letters that fold to ascii
+		"ünï", "ÜNÏ", "straße", "STRASSE", "ÄÖÜ", "sed", "SED", "kelvin", "KELVIN", "ſ",
+		// concatenation and repetition
+		"a.*b", "py.?thon", "comp+ression", "(ba)+z", "z{2}", "[a-c]ar", `\d\d`, `ver.ion \d+`, "7z(FM)?",
+		// everything
+		"", ".", ".*",
+	}
+	fieldLists := []string{"name", "bins", "description", "name,bins", "name,bins,description"}
+
+	defer func(arch string) { g_Arch = arch }(g_Arch)
+	for _, arch := range []string{"64bit", "all"} {
+		g_Arch = arch
+		for _, pattern := range patterns {
+			for _, fields := range fieldLists {
+				query := &SearchQuery{Pattern: regexp.MustCompile("(?i)" + pattern), Fields: strings.Split(fields, ",")}
+
+				want := appNames(filterAppList(query, trigramTestApps()))
+
+				apps := trigramTestApps()
+				registerTrigramIndex(apps, buildTrigramIndex(apps))
+				got := appNames(filterAppList(query, apps))
+
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("-arch %s, %q in %s: got %v with the index, want %v", arch, pattern, fields, got, want)
+				}
+			}
+		}
+	}
+}
+
+// the index does rule out apps, or the test above would pass without it
+func TestTrigramIndexSkipsApps(t *testing.T) {
+	apps := trigramTestApps()
+	registerTrigramIndex(apps, buildTrigramIndex(apps))
+	query := &SearchQuery{Pattern: regexp.MustCompile("(?i)zip|rar"), Fields: []string{"name", "bins"}}
+
+	candidates := trigramCandidates(query, apps)
+	if candidates == nil {
+		t.Fatal("all apps are candidates")
+	}
+	for i, app := range apps {
+		if app.Name == "python" && candidates[i] {
+			t.Errorf("%s is a candidate", app.Name)
+		}
+	}
+}
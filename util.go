@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 	// "encoding/json"
 )
@@ -34,6 +38,25 @@ func check(err error) {
 // 	return false
 // }
 
+// log.Println to out, with the same timestamp
+func logTo(out io.Writer, v ...interface{}) {
+	log.New(out, "", log.LstdFlags).Println(v...)
+}
+
+// indents the lines after the first, to print a multi-line error under its first line
+func indentLines(s string, indent string) string {
+	return strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\n"+indent)
+}
+
+func hasAnySuffix(s string, suffixes ...string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
 func MinInt(x, y int) int {
 	if x < y {
 		return x
@@ -48,6 +71,20 @@ func MaxInt(x, y int) int {
 	return y
 }
 
+func MinDuration(x, y time.Duration) time.Duration {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+func MaxDuration(x, y time.Duration) time.Duration {
+	if x > y {
+		return x
+	}
+	return y
+}
+
 func fmtDuration(dur time.Duration) string {
 	//dur = dur.Round(time.Second)
 	Day := 24 * time.Hour
@@ -59,7 +96,7 @@ func fmtDuration(dur time.Duration) string {
 	//mrem := hrem % time.Minute
 	//s := mrem / time.Second
 	//str := ""
-	if 24 < h {
+	if 0 < d {
 		//return fmt.Sprintf("%dd%dh", d, h)
 		return fmt.Sprintf("%dd", d) // day
 	}
@@ -70,6 +107,53 @@ func fmtDuration(dur time.Duration) string {
 	return fmt.Sprintf("%dm", m) // minutes
 }
 
+// parses a duration that may also be in days or weeks, e.g. 30d, 2w, 12h
+func parseAge(str string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if number, found := strings.CutSuffix(str, suffix); found {
+			n, err := strconv.ParseFloat(number, 64)
+			if err != nil {
+				return 0, fmt.Errorf("bad duration: %s", str)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(str)
+}
+
+var g_SizeRE = regexp.MustCompile(`(?i)^\s*([0-9.]+)\s*([kmgt]?)i?b?\s*$`)
+
+// parses a size in bytes with an optional binary unit, e.g. 500MB, 2G, 100k
+func parseSize(str string) (int64, error) {
+	m := g_SizeRE.FindStringSubmatch(str)
+	if m == nil {
+		return 0, fmt.Errorf("bad size: %s", str)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad size: %s", str)
+	}
+	shift := strings.Index("kmgt", strings.ToLower(m[2])) + 1 // 0 for bytes
+	if m[2] == "" {
+		shift = 0
+	}
+	return int64(n * float64(int64(1)<<(10*shift))), nil
+}
+
+func fmtSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	value, units := float64(size)/unit, "KMGT"
+	i := 0
+	for value >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f%cB", value, units[i])
+}
+
 func FirstPathThatExists(paths []string) string {
 	for _, path := range paths {
 		if _, err := os.Stat(path); err != nil { //!errors.Is(err, os.ErrNotExist) {